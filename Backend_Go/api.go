@@ -0,0 +1,365 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+
+	"github.com/gorilla/mux"
+)
+
+// Error codes returned in /api/v1 error objects
+const (
+	errCodeInvalidRequest     = "invalid_request"
+	errCodeNotFound           = "not_found"
+	errCodePaymentRequired    = "payment_required"
+	errCodeUpstreamFailed     = "upstream_failed"     // a peer or the DHT didn't do what we asked
+	errCodeVerificationFailed = "verification_failed" // content didn't match its CID
+	errCodeInternal           = "internal"
+)
+
+// apiError is an error that knows how it should be reported to HTTP clients. The
+// operations behind both the /api/v1 routes and the older routes return these, so the
+// two agree on status codes.
+type apiError struct {
+	Status  int    `json:"-"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Details any    `json:"details,omitempty"`
+}
+
+func (e *apiError) Error() string { return e.Message }
+
+func newAPIError(status int, code, format string, args ...any) *apiError {
+	return &apiError{Status: status, Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+func badRequest(format string, args ...any) *apiError {
+	return newAPIError(http.StatusBadRequest, errCodeInvalidRequest, format, args...)
+}
+
+func notFound(format string, args ...any) *apiError {
+	return newAPIError(http.StatusNotFound, errCodeNotFound, format, args...)
+}
+
+func upstreamFailed(format string, args ...any) *apiError {
+	return newAPIError(http.StatusBadGateway, errCodeUpstreamFailed, format, args...)
+}
+
+// Anything that isn't already an apiError is an internal failure. Its text is logged
+// rather than sent, since it may name local paths.
+func asAPIError(err error) *apiError {
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+	log.Printf("Internal error: %v", err)
+	return newAPIError(http.StatusInternalServerError, errCodeInternal, "internal error")
+}
+
+// Every /api/v1 response body is one of these: data on success, error otherwise
+type apiEnvelope struct {
+	Data  any       `json:"data,omitempty"`
+	Error *apiError `json:"error,omitempty"`
+}
+
+func writeAPIData(w http.ResponseWriter, status int, data any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(apiEnvelope{Data: data})
+}
+
+func writeAPIError(w http.ResponseWriter, err error) {
+	apiErr := asAPIError(err)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(apiErr.Status)
+	json.NewEncoder(w).Encode(apiEnvelope{Error: apiErr})
+}
+
+// The older routes answer errors in plain text, but with the same status codes
+func writeLegacyError(w http.ResponseWriter, err error) {
+	apiErr := asAPIError(err)
+	http.Error(w, apiErr.Message, apiErr.Status)
+}
+
+// Decodes a JSON request body into v, rejecting unknown fields so typos don't pass silently
+func decodeAPIBody(r *http.Request, v any) error {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return badRequest("invalid JSON body: %v", err)
+	}
+	return nil
+}
+
+// Sets CORS headers on every /api/v1 response and answers preflight requests
+func apiCORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "http://localhost:5173") // Change to your frontend's URL
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Disposition")
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// registerAPIv1 mounts the versioned JSON API under /api/v1. The unversioned routes
+// registered in main stay as shims over the same operations while clients move over.
+func (h *dhtHandler) registerAPIv1(r *mux.Router) {
+	api := r.PathPrefix("/api/v1").Subrouter()
+	api.Use(apiCORS)
+
+	api.HandleFunc("/catalog", h.apiListCatalog).Methods("GET", "OPTIONS")
+	api.HandleFunc("/catalog", h.apiAdvertise).Methods("POST")
+	api.HandleFunc("/catalog/upload", h.apiUpload).Methods("POST", "OPTIONS")
+	api.HandleFunc("/catalog/{cid}", h.apiGetCatalogEntry).Methods("GET", "OPTIONS")
+	api.HandleFunc("/catalog/{cid}", h.apiUpdateCatalogEntry).Methods("PUT")
+	api.HandleFunc("/catalog/{cid}", h.apiRemoveCatalogEntry).Methods("DELETE")
+	api.HandleFunc("/providers/{cid}", h.apiProviders).Methods("GET", "OPTIONS")
+	api.HandleFunc("/peers/{peerID}/listings", h.apiPeerListings).Methods("POST", "OPTIONS")
+	api.HandleFunc("/reputation", h.apiListReputation).Methods("GET", "OPTIONS")
+	api.HandleFunc("/transfers", h.apiTransfer).Methods("POST", "OPTIONS")
+	api.HandleFunc("/transfers/{transferID}/unlock", h.apiUnlockTransfer).Methods("POST", "OPTIONS")
+	api.HandleFunc("/downloads", h.apiListDownloads).Methods("GET", "OPTIONS")
+	api.HandleFunc("/settings/cid", h.apiGetCIDSettings).Methods("GET", "OPTIONS")
+	api.HandleFunc("/settings/cid", h.apiPutCIDSettings).Methods("PUT")
+
+	// A subrouter reports a known path with the wrong method as not found, so tell the
+	// two apart here
+	api.NotFoundHandler = apiCORS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		methodMismatch := false
+		api.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+			var match mux.RouteMatch
+			if !route.Match(r, &match) && match.MatchErr == mux.ErrMethodMismatch {
+				methodMismatch = true
+			}
+			return nil
+		})
+		if methodMismatch {
+			writeAPIError(w, newAPIError(http.StatusMethodNotAllowed, errCodeInvalidRequest, "%s is not allowed on %s", r.Method, r.URL.Path))
+			return
+		}
+		writeAPIError(w, notFound("no such endpoint %s", r.URL.Path))
+	}))
+}
+
+// GET /api/v1/catalog
+func (h *dhtHandler) apiListCatalog(w http.ResponseWriter, r *http.Request) {
+	entries, err := listCatalog()
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeAPIData(w, http.StatusOK, entries)
+}
+
+// POST /api/v1/catalog with an advertiseRequest body. Answers 200 with the existing
+// entry if the CID was already listed.
+func (h *dhtHandler) apiAdvertise(w http.ResponseWriter, r *http.Request) {
+	var req advertiseRequest
+	if err := decodeAPIBody(r, &req); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	metadata, exists, err := h.advertise(context.Background(), req)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	status := http.StatusCreated
+	if exists {
+		status = http.StatusOK
+	}
+	writeAPIData(w, status, metadata)
+}
+
+// POST /api/v1/catalog/upload, taking the same bodies as /advertise/upload
+func (h *dhtHandler) apiUpload(w http.ResponseWriter, r *http.Request) {
+	metadata, exists, err := h.advertiseUpload(w, r)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	status := http.StatusCreated
+	if exists {
+		status = http.StatusOK
+	}
+	writeAPIData(w, status, metadata)
+}
+
+// GET /api/v1/catalog/{cid}
+func (h *dhtHandler) apiGetCatalogEntry(w http.ResponseWriter, r *http.Request) {
+	metadata, err := getCatalogEntry(mux.Vars(r)["cid"])
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeAPIData(w, http.StatusOK, metadata)
+}
+
+// PUT /api/v1/catalog/{cid} with a catalogUpdate body
+func (h *dhtHandler) apiUpdateCatalogEntry(w http.ResponseWriter, r *http.Request) {
+	var update catalogUpdate
+	if err := decodeAPIBody(r, &update); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	metadata, err := h.updateCatalogEntry(context.Background(), mux.Vars(r)["cid"], update)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeAPIData(w, http.StatusOK, metadata)
+}
+
+// DELETE /api/v1/catalog/{cid}
+func (h *dhtHandler) apiRemoveCatalogEntry(w http.ResponseWriter, r *http.Request) {
+	if err := removeCatalogEntry(mux.Vars(r)["cid"]); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GET /api/v1/providers/{cid}, taking ?maxprice=, ?sort=price|latency|reputation,
+// ?limit= and ?offline=false
+func (h *dhtHandler) apiProviders(w http.ResponseWriter, r *http.Request) {
+	pq, err := providerQueryFromValues(r.URL.Query())
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	providers, err := h.findProviders(r.Context(), mux.Vars(r)["cid"], pq)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeAPIData(w, http.StatusOK, providers)
+}
+
+// POST /api/v1/peers/{peerID}/listings with a cidBatchRequest body: everything the
+// peer lists that matches, fetched in one round trip
+func (h *dhtHandler) apiPeerListings(w http.ResponseWriter, r *http.Request) {
+	peerID, err := parsePeerID(mux.Vars(r)["peerID"])
+	if err != nil {
+		writeAPIError(w, badRequest("%v", err))
+		return
+	}
+	var req cidBatchRequest
+	if err := decodeAPIBody(r, &req); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	if err := req.validate(); err != nil {
+		writeAPIError(w, badRequest("%v", err))
+		return
+	}
+	listings, err := queryPeerCatalog(r.Context(), h.node, peerID, req)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	if listings.Metadata == nil {
+		listings.Metadata = []FileMetadata{}
+	}
+	writeAPIData(w, http.StatusOK, listings)
+}
+
+// GET /api/v1/reputation: every peer we've dealt with, best score first
+func (h *dhtHandler) apiListReputation(w http.ResponseWriter, r *http.Request) {
+	reps, err := catalog.Reputations()
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	type scoredPeer struct {
+		peerReputation
+		Score float64 `json:"score"`
+	}
+	scored := make([]scoredPeer, 0, len(reps))
+	for _, rep := range reps {
+		scored = append(scored, scoredPeer{rep, rep.score()})
+	}
+	sort.SliceStable(scored, func(i, j int) bool { return scored[i].Score > scored[j].Score })
+	writeAPIData(w, http.StatusOK, scored)
+}
+
+// POST /api/v1/transfers with a transferRequest body. Paid files answer 402 with the
+// locked download, whose transfer_id is then unlocked with the payment.
+func (h *dhtHandler) apiTransfer(w http.ResponseWriter, r *http.Request) {
+	var req transferRequest
+	if err := decodeAPIBody(r, &req); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	outcome, err := h.downloadFile(context.Background(), req)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	if outcome.Locked != nil {
+		apiErr := newAPIError(http.StatusPaymentRequired, errCodePaymentRequired, "pay %f to %s with memo %s to unlock this file", outcome.Locked.Price, outcome.Locked.WalletAddress, outcome.Locked.TransferID)
+		apiErr.Details = outcome.Locked
+		writeAPIError(w, apiErr)
+		return
+	}
+	writeAPIData(w, http.StatusOK, outcome)
+}
+
+// POST /api/v1/transfers/{transferID}/unlock with {"txid": ...}
+func (h *dhtHandler) apiUnlockTransfer(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		TxID string `json:"txid"`
+	}
+	if err := decodeAPIBody(r, &req); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	record, err := h.unlockTransfer(r.Context(), mux.Vars(r)["transferID"], req.TxID)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeAPIData(w, http.StatusOK, record)
+}
+
+// GET /api/v1/downloads, newest first
+func (h *dhtHandler) apiListDownloads(w http.ResponseWriter, r *http.Request) {
+	records, err := catalog.Downloads()
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].CompletedAt.After(records[j].CompletedAt) })
+	if records == nil {
+		records = []downloadRecord{}
+	}
+	writeAPIData(w, http.StatusOK, records)
+}
+
+// GET /api/v1/settings/cid
+func (h *dhtHandler) apiGetCIDSettings(w http.ResponseWriter, r *http.Request) {
+	writeAPIData(w, http.StatusOK, nodeCIDOptions())
+}
+
+// PUT /api/v1/settings/cid with a cidOverrides body
+func (h *dhtHandler) apiPutCIDSettings(w http.ResponseWriter, r *http.Request) {
+	var o cidOverrides
+	if err := decodeAPIBody(r, &o); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	opts, err := saveCIDSettings(o)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeAPIData(w, http.StatusOK, opts)
+}
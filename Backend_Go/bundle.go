@@ -0,0 +1,374 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// bundleManifest describes a shared directory. The manifest itself is shared like
+// any other file, so its CID is the one thing needed to fetch the whole tree.
+type bundleManifest struct {
+	Name    string          `json:"name"`
+	Entries []manifestEntry `json:"entries"`
+}
+
+type manifestEntry struct {
+	Path string `json:"path"` // slash-separated, relative to the bundle root
+	Size int64  `json:"size"`
+	CID  string `json:"cid"`
+}
+
+// advertiseFolder lists every regular file under root through advertiseFile, with the
+// description, price and wallet of template, and collects them into a manifest sorted
+// by path so the same tree always produces the same manifest CID. It stops at the
+// first file that can't be listed or provided.
+func (h *dhtHandler) advertiseFolder(ctx context.Context, root string, template FileMetadata, opts cidOptions) (bundleManifest, error) {
+	manifest := bundleManifest{Name: filepath.Base(root)}
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		metadata := template
+		metadata.FileDescription = fmt.Sprintf("%s (%s)", template.FileDescription, filepath.ToSlash(rel))
+		metadata.FilePath = path
+		c, _, err := h.advertiseFile(ctx, metadata, opts, false)
+		if err != nil {
+			return err
+		}
+		manifest.Entries = append(manifest.Entries, manifestEntry{
+			Path: filepath.ToSlash(rel),
+			Size: info.Size(),
+			CID:  c.String(),
+		})
+		return nil
+	})
+	if err != nil {
+		return bundleManifest{}, err
+	}
+	sort.Slice(manifest.Entries, func(i, j int) bool {
+		return manifest.Entries[i].Path < manifest.Entries[j].Path
+	})
+	return manifest, nil
+}
+
+// Directory the node keeps the manifests it shares in
+func getManifestDir() (string, error) {
+	downloadPath, err := getDownloadPath()
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(downloadPath, node_id+"-manifests")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create manifest directory: %w", err)
+	}
+	return dir, nil
+}
+
+// Serializes the manifest, stores it under the manifest directory and returns its CID and path
+func storeManifest(manifest bundleManifest, opts cidOptions) (cid.Cid, string, error) {
+	data, err := json.MarshalIndent(manifest, "", " ")
+	if err != nil {
+		return cid.Undef, "", fmt.Errorf("failed to encode manifest: %w", err)
+	}
+	c, err := opts.sum(data)
+	if err != nil {
+		return cid.Undef, "", err
+	}
+
+	dir, err := getManifestDir()
+	if err != nil {
+		return cid.Undef, "", err
+	}
+	path := filepath.Join(dir, c.String()+".json")
+	if err := writeFileAtomic(path, data, 0644); err != nil {
+		return cid.Undef, "", fmt.Errorf("failed to write manifest: %w", err)
+	}
+	return c, path, nil
+}
+
+func readManifest(path string) (bundleManifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return bundleManifest{}, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	var manifest bundleManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return bundleManifest{}, fmt.Errorf("failed to parse manifest: %w", err)
+	}
+	return manifest, nil
+}
+
+// Handler to share a whole directory: every file is listed at the given price and
+// the manifest tying them together is listed for free.
+func (h *dhtHandler) advertiseFolderHandler(w http.ResponseWriter, r *http.Request) {
+	// Set CORS headers
+	w.Header().Set("Access-Control-Allow-Origin", "http://localhost:5173") // Change to your frontend's URL
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+
+	// Handle preflight OPTIONS request
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	folderPath := r.URL.Query().Get("folderpath")
+	price := r.URL.Query().Get("price")
+	description := r.URL.Query().Get("description")
+	walletAddress := r.URL.Query().Get("walletaddress")
+
+	// Walk the real directory, so the manifest paths match the canonical ones advertiseFile lists
+	folderPath, err := filepath.Abs(folderPath)
+	if err == nil {
+		folderPath, err = filepath.EvalSymlinks(folderPath)
+	}
+	if err != nil || r.URL.Query().Get("folderpath") == "" {
+		http.Error(w, "folderpath must be an existing directory", http.StatusBadRequest)
+		return
+	}
+	if info, err := os.Stat(folderPath); err != nil || !info.IsDir() {
+		http.Error(w, "folderpath must be an existing directory", http.StatusBadRequest)
+		return
+	}
+	priceFloat, err := strconv.ParseFloat(price, 64)
+	if err != nil || priceFloat < 0 {
+		http.Error(w, "Invalid price", http.StatusBadRequest)
+		return
+	}
+	opts, err := cidOptionsFromQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx := context.Background()
+	manifest, err := h.advertiseFolder(ctx, folderPath, FileMetadata{
+		FileDescription: description,
+		Price:           priceFloat,
+		WalletAddress:   walletAddress,
+	}, opts)
+	if err != nil {
+		log.Printf("Failed to advertise folder %s: %v", folderPath, err)
+		writeLegacyError(w, err)
+		return
+	}
+	manifestCID, manifestPath, err := storeManifest(manifest, opts)
+	if err != nil {
+		log.Printf("%v", err)
+		http.Error(w, "Failed to store manifest", http.StatusInternalServerError)
+		return
+	}
+
+	if err := h.kadDHT.Provide(ctx, manifestCID, true); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to provide manifest: %v", err), http.StatusInternalServerError)
+		return
+	}
+	err = catalog.Add(FileMetadata{
+		CID:             manifestCID.String(),
+		FileDescription: fmt.Sprintf("%s [folder: %s, %d files]", description, manifest.Name, len(manifest.Entries)),
+		Price:           0,
+		FilePath:        manifestPath,
+		WalletAddress:   walletAddress,
+	})
+	if err != nil {
+		writeLegacyError(w, err)
+		return
+	}
+
+	log.Printf("Successfully advertised folder %s as manifest CID: %s", folderPath, manifestCID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		ManifestCID string         `json:"manifest_cid"`
+		Manifest    bundleManifest `json:"manifest"`
+	}{manifestCID.String(), manifest})
+}
+
+// Reduces the seller's name for a bundle to a single path element, so the tree is
+// always rebuilt in a directory of its own
+func bundleDirName(name string) string {
+	name = filepath.Clean(strings.ReplaceAll(name, "\\", "/"))
+	if name == "." || !filepath.IsLocal(name) || strings.ContainsAny(name, "/"+string(filepath.Separator)) {
+		return "bundle"
+	}
+	return name
+}
+
+// Per-entry outcome of a bundle download
+type bundleEntryResult struct {
+	Path   string          `json:"path"`
+	CID    string          `json:"cid"`
+	Status string          `json:"status"` // ok, locked, failed
+	Error  string          `json:"error,omitempty"`
+	Locked *lockedDownload `json:"locked,omitempty"`
+}
+
+// Picks the manifest entries to download; an empty selection means all of them
+func selectManifestEntries(manifest bundleManifest, selection []string) ([]manifestEntry, error) {
+	if len(selection) == 0 {
+		return manifest.Entries, nil
+	}
+	byPath := make(map[string]manifestEntry, len(manifest.Entries))
+	for _, entry := range manifest.Entries {
+		byPath[entry.Path] = entry
+	}
+	var selected []manifestEntry
+	for _, path := range selection {
+		path = strings.TrimSpace(path)
+		entry, ok := byPath[path]
+		if !ok {
+			return nil, fmt.Errorf("path %q is not in the manifest", path)
+		}
+		selected = append(selected, entry)
+	}
+	return selected, nil
+}
+
+// Handler to fetch a bundle's manifest from a peer and rebuild all or some of its tree
+// under the downloads directory. paths is an optional comma-separated selection.
+func (h *dhtHandler) downloadBundleHandler(w http.ResponseWriter, r *http.Request) {
+	// Set CORS headers
+	w.Header().Set("Access-Control-Allow-Origin", "http://localhost:5173") // Change to your frontend's URL
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+
+	// Handle preflight OPTIONS request
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	targetID, err := parsePeerID(r.URL.Query().Get("targetPeerID"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// The CID names files under the downloads directory, so only ever use its canonical form
+	c, err := cid.Decode(r.URL.Query().Get("cid"))
+	if err != nil {
+		http.Error(w, "Invalid CID", http.StatusBadRequest)
+		return
+	}
+	manifestCID := c.String()
+	var selection []string
+	if paths := r.URL.Query().Get("paths"); paths != "" {
+		selection = strings.Split(paths, ",")
+	}
+
+	downloadPath, err := getDownloadPath()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Step 1: Fetch and verify the manifest
+	ctx := context.Background()
+	manifestPath := filepath.Join(downloadPath, manifestCID+".manifest.json")
+	result, err := h.fetchFromPeer(ctx, targetID, manifestCID, manifestPath, nil)
+	if errors.Is(err, errCIDMismatch) {
+		http.Error(w, "Manifest does not match its CID", http.StatusBadGateway)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to fetch manifest %s: %v", manifestCID, err)
+		http.Error(w, "Failed to fetch manifest", http.StatusBadGateway)
+		return
+	}
+	if result.Locked != nil {
+		http.Error(w, "Manifest is not free to fetch", http.StatusBadGateway)
+		return
+	}
+	defer os.Remove(manifestPath)
+	manifest, err := readManifest(manifestPath)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	entries, err := selectManifestEntries(manifest, selection)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Step 2: Fetch each selected file into the rebuilt tree. The seller picks the
+	// name, so it only ever names a directory of its own under the manifest's CID.
+	bundleRoot := filepath.Join(downloadPath, manifestCID, bundleDirName(manifest.Name))
+	results := make([]bundleEntryResult, 0, len(entries))
+	for _, entry := range entries {
+		res := bundleEntryResult{Path: entry.Path, CID: entry.CID}
+		results = append(results, h.fetchBundleEntry(ctx, targetID, bundleRoot, entry, res))
+	}
+
+	log.Printf("Bundle %s downloaded into '%s' (%d entries)", manifestCID, bundleRoot, len(results))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Root    string              `json:"root"`
+		Entries []bundleEntryResult `json:"entries"`
+	}{bundleRoot, results})
+}
+
+func (h *dhtHandler) fetchBundleEntry(ctx context.Context, targetID peer.ID, bundleRoot string, entry manifestEntry, res bundleEntryResult) bundleEntryResult {
+	fail := func(err error) bundleEntryResult {
+		res.Status = "failed"
+		res.Error = err.Error()
+		return res
+	}
+
+	// Never let a manifest write outside the bundle directory
+	rel := filepath.FromSlash(entry.Path)
+	if !filepath.IsLocal(rel) {
+		return fail(fmt.Errorf("unsafe path in manifest"))
+	}
+	outputPath := filepath.Join(bundleRoot, rel)
+	if err := os.MkdirAll(filepath.Dir(outputPath), 0755); err != nil {
+		return fail(err)
+	}
+	// Never write over a file that is already there; one from an earlier download of
+	// the bundle is fine as long as it still matches
+	if _, err := os.Lstat(outputPath); err == nil {
+		if err := verifyFileCID(outputPath, entry.CID); err != nil {
+			return fail(fmt.Errorf("a different file already exists at %s", entry.Path))
+		}
+		res.Status = "ok"
+		return res
+	}
+
+	result, err := h.fetchFromPeer(ctx, targetID, entry.CID, outputPath, nil)
+	if err != nil {
+		return fail(err)
+	}
+	if result.Locked != nil {
+		res.Status = "locked"
+		res.Locked = result.Locked
+		return res
+	}
+	catalog.RecordDownload(downloadRecord{CID: entry.CID, Path: outputPath, Peer: targetID.String(), Size: entry.Size, CompletedAt: time.Now()})
+	res.Status = "ok"
+	return res
+}
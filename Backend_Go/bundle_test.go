@@ -0,0 +1,24 @@
+package main
+
+import "testing"
+
+// Whatever a seller names its bundle, the tree goes in one directory of its own
+func TestBundleDirName(t *testing.T) {
+	for name, want := range map[string]string{
+		"photos":      "photos",
+		"photos/":     "photos",
+		"":            "bundle",
+		".":           "bundle",
+		"./":          "bundle",
+		"..":          "bundle",
+		"/":           "bundle",
+		"/etc":        "bundle",
+		"a/b":         "bundle",
+		"..\\escape":  "bundle",
+		"sub/../name": "name",
+	} {
+		if got := bundleDirName(name); got != want {
+			t.Errorf("bundleDirName(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
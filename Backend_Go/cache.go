@@ -0,0 +1,405 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+)
+
+const (
+	cacheIndexFile       = "index.json"
+	defaultMaxCacheBytes = 5 << 30 // 5 GiB
+	seededDescription    = "Seeded download"
+	seedingPolicySetting = "seeding_policy"
+)
+
+// seedingPolicy decides whether verified downloads are kept in the managed cache and
+// provided to the network again. Seeding is off until the user turns it on.
+type seedingPolicy struct {
+	Enabled       bool    `json:"enabled"`
+	Price         float64 `json:"price"`
+	WalletAddress string  `json:"walletaddress"`
+	MaxCacheBytes int64   `json:"max_cache_bytes"`
+}
+
+type cacheEntry struct {
+	CID        string    `json:"cid"`
+	Size       int64     `json:"size"`
+	LastAccess time.Time `json:"last_access"`
+	Seeded     bool      `json:"seeded"`
+}
+
+// contentCache is the managed directory of downloaded content. It is capped at
+// MaxCacheBytes and evicts the least recently used entries first.
+type contentCache struct {
+	mu      sync.Mutex
+	dir     string
+	policy  seedingPolicy
+	entries map[string]*cacheEntry
+}
+
+// The node's managed cache, set up in main
+var downloadCache *contentCache
+
+type cacheIndex struct {
+	Policy  *seedingPolicy `json:"policy,omitempty"` // older indexes kept the policy here
+	Entries []*cacheEntry  `json:"entries"`
+}
+
+func openContentCache() (*contentCache, error) {
+	dir, err := getContentCacheDir()
+	if err != nil {
+		return nil, err
+	}
+	c := &contentCache{
+		dir:     dir,
+		policy:  seedingPolicy{MaxCacheBytes: defaultMaxCacheBytes},
+		entries: make(map[string]*cacheEntry),
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, cacheIndexFile))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read cache index: %w", err)
+	}
+	if err == nil {
+		var index cacheIndex
+		if err := json.Unmarshal(data, &index); err != nil {
+			return nil, fmt.Errorf("failed to parse cache index: %w", err)
+		}
+		if index.Policy != nil {
+			c.policy = *index.Policy
+		}
+		for _, entry := range index.Entries {
+			c.entries[entry.CID] = entry
+		}
+	}
+
+	// The policy now lives in the settings bucket; older ones are carried over from the index
+	var policy seedingPolicy
+	found, err := catalog.Setting(seedingPolicySetting, &policy)
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		c.policy = policy
+	} else if err := catalog.PutSetting(seedingPolicySetting, c.policy); err != nil {
+		return nil, err
+	}
+
+	// Pick up anything cached without going through the index, drop entries whose file is gone
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list cache directory: %w", err)
+	}
+	present := make(map[string]bool)
+	for _, f := range files {
+		if _, err := cid.Decode(f.Name()); err != nil || !f.Type().IsRegular() {
+			continue
+		}
+		present[f.Name()] = true
+		if _, ok := c.entries[f.Name()]; !ok {
+			info, err := f.Info()
+			if err != nil {
+				continue
+			}
+			c.entries[f.Name()] = &cacheEntry{CID: f.Name(), Size: info.Size(), LastAccess: info.ModTime()}
+		}
+	}
+	for id := range c.entries {
+		if !present[id] {
+			delete(c.entries, id)
+		}
+	}
+	return c, nil
+}
+
+func (c *contentCache) path(cidStr string) string {
+	return filepath.Join(c.dir, cidStr)
+}
+
+// Must be called with c.mu held
+func (c *contentCache) saveLocked() error {
+	var index cacheIndex
+	for _, entry := range c.entries {
+		index.Entries = append(index.Entries, entry)
+	}
+	data, err := json.MarshalIndent(index, "", " ")
+	if err != nil {
+		return fmt.Errorf("failed to encode cache index: %w", err)
+	}
+	if err := writeFileAtomic(filepath.Join(c.dir, cacheIndexFile), data, 0644); err != nil {
+		return fmt.Errorf("failed to write cache index: %w", err)
+	}
+	return nil
+}
+
+func (c *contentCache) Policy() seedingPolicy {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.policy
+}
+
+func (c *contentCache) SetPolicy(p seedingPolicy) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if p.MaxCacheBytes <= 0 {
+		p.MaxCacheBytes = defaultMaxCacheBytes
+	}
+	if err := catalog.PutSetting(seedingPolicySetting, p); err != nil {
+		return err
+	}
+	c.policy = p
+	c.evictLocked()
+	return c.saveLocked()
+}
+
+// Records an access so the entry moves to the back of the eviction order
+func (c *contentCache) Touch(cidStr string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if entry, ok := c.entries[cidStr]; ok {
+		entry.LastAccess = time.Now()
+	}
+}
+
+func (c *contentCache) Usage() (int64, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var total int64
+	for _, entry := range c.entries {
+		total += entry.Size
+	}
+	return total, len(c.entries)
+}
+
+// Add brings a verified file into the cache (hard-linking when possible) and evicts
+// older entries to stay under the cap. It returns the cached path.
+func (c *contentCache) Add(cidStr, src string, seeded bool) (string, error) {
+	dst := c.path(cidStr)
+	if src != dst {
+		if err := linkOrCopy(src, dst); err != nil {
+			return "", err
+		}
+	}
+	info, err := os.Stat(dst)
+	if err != nil {
+		return "", err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[cidStr] = &cacheEntry{CID: cidStr, Size: info.Size(), LastAccess: time.Now(), Seeded: seeded}
+	c.evictLocked()
+	if _, ok := c.entries[cidStr]; !ok {
+		return "", fmt.Errorf("file is larger than the cache limit")
+	}
+	return dst, c.saveLocked()
+}
+
+// Must be called with c.mu held
+func (c *contentCache) evictLocked() {
+	var total int64
+	ordered := make([]*cacheEntry, 0, len(c.entries))
+	for _, entry := range c.entries {
+		total += entry.Size
+		ordered = append(ordered, entry)
+	}
+	sort.Slice(ordered, func(i, j int) bool {
+		return ordered[i].LastAccess.Before(ordered[j].LastAccess)
+	})
+
+	for _, entry := range ordered {
+		if total <= c.policy.MaxCacheBytes {
+			break
+		}
+		if err := os.Remove(c.path(entry.CID)); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to evict %s from cache: %v", entry.CID, err)
+			continue
+		}
+		if entry.Seeded {
+			// Stop listing what we no longer have; the DHT provider record will expire on its own.
+			// A listing for the same CID that points at a file of the user's own stays.
+			if metadata, found := catalog.Get(entry.CID); found && metadata.FilePath == c.path(entry.CID) {
+				if err := catalog.Remove(entry.CID); err != nil {
+					log.Printf("%v", err)
+				}
+			}
+		}
+		delete(c.entries, entry.CID)
+		total -= entry.Size
+		log.Printf("Evicted %s (%d bytes) from the download cache", entry.CID, entry.Size)
+	}
+}
+
+// Brings src into the cache at dst. dst is never opened in place: a download may
+// already be hard-linked to it, and truncating that inode would empty both files.
+func linkOrCopy(src, dst string) error {
+	srcInfo, err := os.Stat(src)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", src, err)
+	}
+	if dstInfo, err := os.Stat(dst); err == nil && os.SameFile(srcInfo, dstInfo) {
+		return nil
+	}
+
+	// Link or copy next to dst, then rename over it, so readers see the old file or the new one
+	tmp, err := os.CreateTemp(filepath.Dir(dst), "."+filepath.Base(dst)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("failed to create cache file: %w", err)
+	}
+	tmpPath := tmp.Name()
+	tmp.Close()
+	defer os.Remove(tmpPath) // no-op once renamed into place
+	os.Remove(tmpPath)
+	if err := os.Link(src, tmpPath); err != nil {
+		if err := copyFile(src, tmpPath); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(tmpPath, dst); err != nil {
+		return fmt.Errorf("failed to move file into cache: %w", err)
+	}
+	return nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", src, err)
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", dst, err)
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return fmt.Errorf("failed to copy into cache: %w", err)
+	}
+	return out.Close()
+}
+
+// seedDownload adds a verified download to the cache and, if the seeding policy is on,
+// lists it at the policy's price and provides it so other peers can fetch it from us.
+func (h *dhtHandler) seedDownload(cidStr, path string) {
+	if downloadCache == nil {
+		return
+	}
+	policy := downloadCache.Policy()
+	if !policy.Enabled {
+		return
+	}
+	c, err := cid.Decode(cidStr)
+	if err != nil {
+		return
+	}
+
+	cachedPath, err := downloadCache.Add(cidStr, path, true)
+	if err != nil {
+		log.Printf("Not seeding %s: %v", cidStr, err)
+		return
+	}
+	err = catalog.Add(FileMetadata{
+		CID:             cidStr,
+		FileDescription: seededDescription,
+		Price:           policy.Price,
+		FilePath:        cachedPath,
+		WalletAddress:   policy.WalletAddress,
+	})
+	if err != nil {
+		log.Printf("%s\n", err)
+		return
+	}
+	if err := h.kadDHT.Provide(context.Background(), c, true); err != nil {
+		log.Printf("Failed to provide seeded CID %s: %v", cidStr, err)
+		return
+	}
+	log.Printf("Seeding downloaded CID %s at price %f", cidStr, policy.Price)
+}
+
+// Indexes a file the gateway fetched so it counts against the cap, seeding it if the policy is on
+func (h *dhtHandler) cacheGatewayDownload(cidStr, path string) {
+	if downloadCache == nil {
+		return
+	}
+	if downloadCache.Policy().Enabled {
+		h.seedDownload(cidStr, path)
+		return
+	}
+	if _, err := downloadCache.Add(cidStr, path, false); err != nil {
+		log.Printf("Failed to cache %s: %v", cidStr, err)
+	}
+}
+
+// Handler to view (GET) or change (POST) the seeding policy
+func (h *dhtHandler) seedingHandler(w http.ResponseWriter, r *http.Request) {
+	// Set CORS headers
+	w.Header().Set("Access-Control-Allow-Origin", "http://localhost:5173") // Change to your frontend's URL
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+
+	// Handle preflight OPTIONS request
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if downloadCache == nil {
+		http.Error(w, "Download cache is unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		policy := downloadCache.Policy()
+		query := r.URL.Query()
+		if v := query.Get("enabled"); v != "" {
+			enabled, err := strconv.ParseBool(v)
+			if err != nil {
+				http.Error(w, "Invalid enabled flag", http.StatusBadRequest)
+				return
+			}
+			policy.Enabled = enabled
+		}
+		if v := query.Get("price"); v != "" {
+			price, err := strconv.ParseFloat(v, 64)
+			if err != nil || price < 0 {
+				http.Error(w, "Invalid price", http.StatusBadRequest)
+				return
+			}
+			policy.Price = price
+		}
+		if query.Has("walletaddress") {
+			policy.WalletAddress = query.Get("walletaddress")
+		}
+		if v := query.Get("maxCacheMB"); v != "" {
+			mb, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || mb <= 0 {
+				http.Error(w, "Invalid maxCacheMB", http.StatusBadRequest)
+				return
+			}
+			policy.MaxCacheBytes = mb << 20
+		}
+		if err := downloadCache.SetPolicy(policy); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	used, count := downloadCache.Usage()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Policy    seedingPolicy `json:"policy"`
+		UsedBytes int64         `json:"used_bytes"`
+		Entries   int           `json:"entries"`
+	}{downloadCache.Policy(), used, count})
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Evicting a seeded download must not drop a listing of the same CID that points at
+// one of the user's own files
+func TestEvictKeepsOwnListing(t *testing.T) {
+	saved := catalog
+	defer func() { catalog = saved }()
+	catalog = openTestStore(t)
+
+	dir := t.TempDir()
+	c := &contentCache{
+		dir:     filepath.Join(dir, "cache"),
+		policy:  seedingPolicy{Enabled: true, MaxCacheBytes: 1 << 20},
+		entries: make(map[string]*cacheEntry),
+	}
+	if err := os.Mkdir(c.dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	download := filepath.Join(dir, "download")
+	if err := os.WriteFile(download, []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	const ownCID, seededCID = "bafkqaaa", "bafkqabb"
+	own := filepath.Join(dir, "own.txt")
+	if err := catalog.Add(FileMetadata{CID: ownCID, FilePath: own}); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{ownCID, seededCID} {
+		cachedPath, err := c.Add(id, download, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Like seedDownload, which keeps an existing listing for the CID
+		if _, found := catalog.Get(id); !found {
+			if err := catalog.Add(FileMetadata{CID: id, FilePath: cachedPath}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// Shrinking the cap evicts both entries
+	if err := c.SetPolicy(seedingPolicy{Enabled: true, MaxCacheBytes: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, count := c.Usage(); count != 0 {
+		t.Fatalf("%d entries left in the cache", count)
+	}
+	if metadata, found := catalog.Get(ownCID); !found || metadata.FilePath != own {
+		t.Errorf("own listing was dropped: %+v, %v", metadata, found)
+	}
+	if _, found := catalog.Get(seededCID); found {
+		t.Errorf("seeded listing was kept after eviction")
+	}
+}
+
+// Caching a download that is already hard-linked into the cache must leave both intact
+func TestLinkOrCopySameFile(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "download")
+	dst := filepath.Join(dir, "cached")
+	if err := os.WriteFile(src, []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := linkOrCopy(src, dst); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A different file replaces dst without touching the old inode
+	other := filepath.Join(dir, "other")
+	if err := os.WriteFile(other, []byte("other content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := linkOrCopy(other, dst); err != nil {
+		t.Fatal(err)
+	}
+
+	for path, want := range map[string]string{src: "content", dst: "other content", other: "other content"} {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != want {
+			t.Errorf("%s holds %q, want %q", filepath.Base(path), data, want)
+		}
+	}
+	assertDirHolds(t, dir, "cached", "download", "other")
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/ipfs/go-cid"
+)
+
+// catalogUpdate is the body of PUT /catalog/{cid}. Fields left out stay as they are.
+type catalogUpdate struct {
+	FileDescription *string  `json:"fileDescription"`
+	Price           *float64 `json:"price"`
+	WalletAddress   *string  `json:"walletaddress"`
+	Tags            []string `json:"tags"`
+}
+
+// Every file we share, ordered by CID
+func listCatalog() ([]FileMetadata, error) {
+	entries, err := catalog.List()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].CID < entries[j].CID })
+	if entries == nil {
+		entries = []FileMetadata{}
+	}
+	return entries, nil
+}
+
+// Catalog entries are keyed by the CID's canonical string. Peers may spell a CID as v0 or
+// in another multibase, so what they send is decoded and re-encoded before any lookup;
+// a string that isn't a CID comes back as it is and simply isn't found.
+func canonicalCID(cidStr string) string {
+	c, err := cid.Decode(cidStr)
+	if err != nil {
+		return cidStr
+	}
+	return c.String()
+}
+
+// Entries are keyed by the CID's canonical string, so cidStr is decoded and re-encoded
+// before the lookup
+func getCatalogEntry(cidStr string) (FileMetadata, error) {
+	c, err := cid.Decode(cidStr)
+	if err != nil {
+		return FileMetadata{}, badRequest("invalid CID %q", cidStr)
+	}
+	metadata, found := catalog.Get(c.String())
+	if !found {
+		return FileMetadata{}, notFound("CID is not in the catalog")
+	}
+	return metadata, nil
+}
+
+// updateCatalogEntry applies update to the entry for cidStr. A new price is announced
+// again so peers looking the CID up reach us and query it.
+func (h *dhtHandler) updateCatalogEntry(ctx context.Context, cidStr string, update catalogUpdate) (FileMetadata, error) {
+	c, err := cid.Decode(cidStr)
+	if err != nil {
+		return FileMetadata{}, badRequest("invalid CID %q", cidStr)
+	}
+	if update.Price != nil && *update.Price < 0 {
+		return FileMetadata{}, badRequest("invalid price %f", *update.Price)
+	}
+
+	var updated FileMetadata
+	priceChanged := false
+	found, err := catalog.Modify(c.String(), func(metadata *FileMetadata) error {
+		if update.FileDescription != nil {
+			metadata.FileDescription = *update.FileDescription
+		}
+		if update.Price != nil && *update.Price != metadata.Price {
+			metadata.Price = *update.Price
+			priceChanged = true
+		}
+		if update.WalletAddress != nil {
+			metadata.WalletAddress = *update.WalletAddress
+		}
+		if update.Tags != nil {
+			metadata.Tags = parseTags(strings.Join(update.Tags, ","))
+		}
+		metadata.UpdatedAt = time.Now()
+		updated = *metadata
+		return nil
+	})
+	if err != nil {
+		return FileMetadata{}, err
+	}
+	if !found {
+		return FileMetadata{}, notFound("CID is not in the catalog")
+	}
+
+	if priceChanged {
+		if err := h.kadDHT.Provide(ctx, c, true); err != nil {
+			return updated, upstreamFailed("price updated but failed to announce it: %v", err)
+		}
+		log.Printf("Announced new price %f for CID %s", updated.Price, c)
+	}
+	return updated, nil
+}
+
+// Stops sharing cidStr. Peers can no longer fetch it from us; the DHT provider record
+// will expire on its own.
+func removeCatalogEntry(cidStr string) error {
+	metadata, err := getCatalogEntry(cidStr)
+	if err != nil {
+		return err
+	}
+	return catalog.Remove(metadata.CID)
+}
+
+// Handler to list every file we share, ordered by CID
+func (h *dhtHandler) listCatalogHandler(w http.ResponseWriter, r *http.Request) {
+	// Set CORS headers
+	w.Header().Set("Access-Control-Allow-Origin", "http://localhost:5173") // Change to your frontend's URL
+	w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+
+	// Handle preflight OPTIONS request
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	entries, err := listCatalog()
+	if err != nil {
+		writeLegacyError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+// Handler for a single catalog entry: GET reads it, PUT changes its description, price
+// or wallet address and DELETE stops sharing it.
+func (h *dhtHandler) catalogEntryHandler(w http.ResponseWriter, r *http.Request) {
+	// Set CORS headers
+	w.Header().Set("Access-Control-Allow-Origin", "http://localhost:5173") // Change to your frontend's URL
+	w.Header().Set("Access-Control-Allow-Methods", "GET, PUT, DELETE, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+
+	// Handle preflight OPTIONS request
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	cidStr := mux.Vars(r)["cid"]
+	var metadata FileMetadata
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		metadata, err = getCatalogEntry(cidStr)
+
+	case http.MethodPut:
+		var update catalogUpdate
+		if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+			http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		metadata, err = h.updateCatalogEntry(context.Background(), cidStr, update)
+
+	case http.MethodDelete:
+		if err := removeCatalogEntry(cidStr); err != nil {
+			writeLegacyError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if err != nil {
+		writeLegacyError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(metadata)
+}
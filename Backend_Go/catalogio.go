@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ipfs/go-cid"
+)
+
+// Column order of catalog CSV exports. Imports match columns by header name, so only
+// filepath and price are required and the rest may come in any order.
+var catalogCSVColumns = []string{
+	"cid", "fileName", "filepath", "fileDescription", "price", "walletaddress",
+	"size", "mimeType", "tags", "createdAt", "updatedAt", "downloadCount",
+}
+
+// Outcome of importing one catalog row
+type importResult struct {
+	Row    int    `json:"row"` // 1-based, not counting the CSV header
+	Path   string `json:"path"`
+	CID    string `json:"cid,omitempty"`
+	Status string `json:"status"` // added, exists, failed
+	Error  string `json:"error,omitempty"`
+}
+
+// resolveSharePath makes path absolute and resolves its symlinks, so one file is always
+// listed, cached and tracked under the same path however it was named
+func resolveSharePath(path string) (string, error) {
+	if path == "" {
+		return "", fmt.Errorf("missing file path")
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", fmt.Errorf("invalid path %s: %w", path, err)
+	}
+	resolved, err := filepath.EvalSymlinks(abs)
+	if err != nil {
+		return "", fmt.Errorf("can't read %s: %w", path, err)
+	}
+	return resolved, nil
+}
+
+// advertiseFile hashes the file at metadata.FilePath, provides its CID and lists it. It
+// reports whether the CID was already in the catalog, in which case nothing is changed.
+// The path is listed in canonical form.
+// A CID already set in metadata is checked against the file, hashed the way it names;
+// otherwise the file is addressed with opts. force ignores the hash cache.
+func (h *dhtHandler) advertiseFile(ctx context.Context, metadata FileMetadata, opts cidOptions, force bool) (cid.Cid, bool, error) {
+	path, err := resolveSharePath(metadata.FilePath)
+	if err != nil {
+		return cid.Undef, false, badRequest("%v", err)
+	}
+	metadata.FilePath = path
+	info, err := os.Stat(metadata.FilePath)
+	if err != nil {
+		return cid.Undef, false, badRequest("can't read %s: %v", metadata.FilePath, err)
+	}
+	if !info.Mode().IsRegular() {
+		return cid.Undef, false, badRequest("%s is not a regular file", metadata.FilePath)
+	}
+	if metadata.Price < 0 {
+		return cid.Undef, false, badRequest("invalid price %f", metadata.Price)
+	}
+	if metadata.CID != "" {
+		expected, err := cid.Decode(metadata.CID)
+		if err != nil {
+			return cid.Undef, false, badRequest("invalid CID %q", metadata.CID)
+		}
+		if opts, err = cidOptionsFor(expected); err != nil {
+			return cid.Undef, false, badRequest("%v", err)
+		}
+	}
+	c, err := hashFileTracked(metadata.FilePath, info.Size(), opts, force)
+	if err != nil {
+		return cid.Undef, false, err
+	}
+	if metadata.CID != "" && metadata.CID != c.String() {
+		return c, false, badRequest("file hashes to %s, not %s", c, metadata.CID)
+	}
+	metadata.CID = c.String()
+	if _, found := catalog.Get(metadata.CID); found {
+		return c, true, nil
+	}
+	if err := h.kadDHT.Provide(ctx, c, true); err != nil {
+		return c, false, upstreamFailed("failed to provide %s: %v", c, err)
+	}
+	return c, false, catalog.Add(metadata)
+}
+
+func writeCatalogCSV(w io.Writer, entries []FileMetadata) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(catalogCSVColumns); err != nil {
+		return err
+	}
+	for _, m := range entries {
+		err := cw.Write([]string{
+			m.CID, m.FileName, m.FilePath, m.FileDescription,
+			strconv.FormatFloat(m.Price, 'f', -1, 64), m.WalletAddress,
+			strconv.FormatInt(m.Size, 10), m.MimeType, strings.Join(m.Tags, ";"),
+			m.CreatedAt.Format(time.RFC3339), m.UpdatedAt.Format(time.RFC3339),
+			strconv.FormatInt(m.DownloadCount, 10),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// Parses a CSV catalog into entries. Rows that can't be parsed come back as failed
+// results and are left out of the entries.
+func readCatalogCSV(r io.Reader) ([]FileMetadata, []int, []importResult, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to read CSV header: %w", err)
+	}
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[strings.TrimSpace(name)] = i
+	}
+	for _, required := range []string{"filepath", "price"} {
+		if _, ok := columns[required]; !ok {
+			return nil, nil, nil, fmt.Errorf("CSV is missing the %s column", required)
+		}
+	}
+
+	var entries []FileMetadata
+	var rows []int
+	var failed []importResult
+	for row := 1; ; row++ {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to read CSV row %d: %w", row, err)
+		}
+		field := func(name string) string {
+			if i, ok := columns[name]; ok && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+		price, err := strconv.ParseFloat(field("price"), 64)
+		if err != nil {
+			failed = append(failed, importResult{Row: row, Path: field("filepath"), Status: "failed", Error: "invalid price"})
+			continue
+		}
+		entries = append(entries, FileMetadata{
+			CID:             field("cid"),
+			FilePath:        field("filepath"),
+			FileDescription: field("fileDescription"),
+			Price:           price,
+			WalletAddress:   field("walletaddress"),
+			Tags:            parseTags(strings.ReplaceAll(field("tags"), ";", ",")),
+		})
+		rows = append(rows, row)
+	}
+	return entries, rows, failed, nil
+}
+
+// Picks json or csv from ?format=, defaulting to JSON
+func catalogFormat(r *http.Request) (string, error) {
+	switch format := strings.ToLower(r.URL.Query().Get("format")); format {
+	case "", "json":
+		return "json", nil
+	case "csv":
+		return "csv", nil
+	default:
+		return "", fmt.Errorf("unsupported format %q", format)
+	}
+}
+
+// Handler to export the whole catalog as JSON or CSV (?format=)
+func (h *dhtHandler) exportCatalogHandler(w http.ResponseWriter, r *http.Request) {
+	// Set CORS headers
+	w.Header().Set("Access-Control-Allow-Origin", "http://localhost:5173") // Change to your frontend's URL
+	w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+
+	// Handle preflight OPTIONS request
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	format, err := catalogFormat(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	entries, err := catalog.List()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].CID < entries[j].CID })
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=catalog.%s", format))
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		if err := writeCatalogCSV(w, entries); err != nil {
+			log.Printf("Failed to write catalog CSV: %v", err)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+// Handler to bulk-import a JSON or CSV catalog (?format=) from the request body. Every
+// row is validated, hashed, provided and listed on its own, and gets its own result.
+func (h *dhtHandler) importCatalogHandler(w http.ResponseWriter, r *http.Request) {
+	// Set CORS headers
+	w.Header().Set("Access-Control-Allow-Origin", "http://localhost:5173") // Change to your frontend's URL
+	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+
+	// Handle preflight OPTIONS request
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	format, err := catalogFormat(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var entries []FileMetadata
+	var rows []int
+	results := []importResult{}
+	if format == "csv" {
+		var failed []importResult
+		entries, rows, failed, err = readCatalogCSV(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		results = append(results, failed...)
+	} else {
+		if err := json.NewDecoder(r.Body).Decode(&entries); err != nil {
+			http.Error(w, "Invalid JSON catalog", http.StatusBadRequest)
+			return
+		}
+		for i := range entries {
+			rows = append(rows, i+1)
+		}
+	}
+
+	ctx := context.Background()
+	for i, entry := range entries {
+		result := importResult{Row: rows[i], Path: entry.FilePath}
+		// Only the fields a user sets; the rest are read off the file again
+		metadata := FileMetadata{
+			CID:             entry.CID,
+			FilePath:        entry.FilePath,
+			FileDescription: entry.FileDescription,
+			Price:           entry.Price,
+			WalletAddress:   entry.WalletAddress,
+			Tags:            entry.Tags,
+		}
+		c, exists, err := h.advertiseFile(ctx, metadata, nodeCIDOptions(), false)
+		if c.Defined() {
+			result.CID = c.String()
+		}
+		switch {
+		case err != nil:
+			result.Status = "failed"
+			result.Error = err.Error()
+		case exists:
+			result.Status = "exists"
+		default:
+			result.Status = "added"
+		}
+		results = append(results, result)
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Row < results[j].Row })
+
+	log.Printf("Imported catalog with %d rows", len(results))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
+// runCatalogCommand implements "catalog export" and "catalog import" against a running
+// node's HTTP API, since the node holds the metadata database open while it runs.
+func runCatalogCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: catalog export|import [flags]")
+	}
+	fs := flag.NewFlagSet("catalog "+args[0], flag.ContinueOnError)
+	nodeURL := fs.String("node", "http://localhost:6100", "address of the running node's HTTP API")
+	format := fs.String("format", "json", "catalog format: json or csv")
+	file := fs.String("file", "", "file to export to or import from (default stdout/stdin)")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	query := url.Values{"format": {*format}}.Encode()
+
+	switch args[0] {
+	case "export":
+		resp, err := http.Get(*nodeURL + "/catalog/export?" + query)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			body, _ := io.ReadAll(resp.Body)
+			return fmt.Errorf("export failed: %s", strings.TrimSpace(string(body)))
+		}
+		out := io.Writer(os.Stdout)
+		if *file != "" {
+			f, err := os.Create(*file)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			out = f
+		}
+		_, err = io.Copy(out, resp.Body)
+		return err
+
+	case "import":
+		in := io.Reader(os.Stdin)
+		if *file != "" {
+			f, err := os.Open(*file)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			in = f
+		}
+		resp, err := http.Post(*nodeURL+"/catalog/import?"+query, "application/octet-stream", in)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			body, _ := io.ReadAll(resp.Body)
+			return fmt.Errorf("import failed: %s", strings.TrimSpace(string(body)))
+		}
+		var results []importResult
+		if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
+			return fmt.Errorf("failed to read import results: %w", err)
+		}
+		failed := 0
+		for _, result := range results {
+			fmt.Printf("%d\t%s\t%s\t%s\n", result.Row, result.Status, result.CID, result.Path)
+			if result.Error != "" {
+				failed++
+				fmt.Printf("\t%s\n", result.Error)
+			}
+		}
+		if failed > 0 {
+			return fmt.Errorf("%d of %d rows failed", failed, len(results))
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("unknown catalog command %q", args[0])
+	}
+}
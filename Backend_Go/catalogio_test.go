@@ -0,0 +1,41 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveSharePath(t *testing.T) {
+	base, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(base, "shared", "sub")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "a.txt")
+	if err := os.WriteFile(file, []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(base, "link.txt")
+	if err := os.Symlink(file, link); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{
+		file,
+		filepath.Join(dir, "..", "sub", "a.txt"),
+		link,
+	} {
+		if got, err := resolveSharePath(path); err != nil || got != file {
+			t.Errorf("%q: got %q, %v", path, got, err)
+		}
+	}
+	for _, path := range []string{filepath.Join(dir, "missing.txt"), ""} {
+		if got, err := resolveSharePath(path); err == nil {
+			t.Errorf("%q was accepted as %q", path, got)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const (
+	maxCIDBatchRequestSize = 1 << 20 // one JSON line
+	maxCIDBatchCIDs        = 1000
+	maxCIDBatchResults     = 1000
+)
+
+// A cid-get 1.2.0 request, sent as one JSON line. An entry matches when its CID is one
+// of CIDs, starts with Prefix, carries every tag in Tags and mentions Text in its name
+// or description. Fields left empty don't narrow the match, so an empty request asks
+// for the whole catalog, up to Limit (or maxCIDBatchResults) entries.
+type cidBatchRequest struct {
+	CIDs   []string `json:"cids,omitempty"`
+	Prefix string   `json:"prefix,omitempty"`
+	Tags   []string `json:"tags,omitempty"`
+	Text   string   `json:"text,omitempty"`
+	Limit  int      `json:"limit,omitempty"`
+	Codecs string   `json:"codecs,omitempty"` // codecs we accept the response in
+}
+
+func encodeCIDBatchRequest(req cidBatchRequest) ([]byte, error) {
+	req.Codecs = acceptedCodecs()
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+func (req cidBatchRequest) validate() error {
+	if len(req.CIDs) > maxCIDBatchCIDs {
+		return fmt.Errorf("at most %d CIDs per request", maxCIDBatchCIDs)
+	}
+	if req.Limit < 0 {
+		return fmt.Errorf("invalid limit %d", req.Limit)
+	}
+	return nil
+}
+
+func (req cidBatchRequest) matches(m FileMetadata) bool {
+	if !strings.HasPrefix(m.CID, req.Prefix) {
+		return false
+	}
+	for _, want := range req.Tags {
+		found := false
+		for _, tag := range m.Tags {
+			if strings.EqualFold(tag, want) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if req.Text != "" {
+		text := strings.ToLower(req.Text)
+		if !strings.Contains(strings.ToLower(m.FileName), text) && !strings.Contains(strings.ToLower(m.FileDescription), text) {
+			return false
+		}
+	}
+	return true
+}
+
+// Catalog entries matching req, ordered by CID
+func matchCatalog(req cidBatchRequest) ([]FileMetadata, error) {
+	var candidates []FileMetadata
+	if len(req.CIDs) > 0 {
+		for _, c := range req.CIDs {
+			if metadata, found := catalog.Get(canonicalCID(c)); found {
+				candidates = append(candidates, metadata)
+			}
+		}
+	} else {
+		var err error
+		if candidates, err = catalog.List(); err != nil {
+			return nil, err
+		}
+	}
+
+	limit := maxCIDBatchResults
+	if req.Limit > 0 && req.Limit < limit {
+		limit = req.Limit
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].CID < candidates[j].CID })
+	matches := []FileMetadata{}
+	for _, metadata := range candidates {
+		if len(matches) == limit {
+			break
+		}
+		if req.matches(metadata) && (len(matches) == 0 || matches[len(matches)-1].CID != metadata.CID) {
+			matches = append(matches, metadata)
+		}
+	}
+	return matches, nil
+}
+
+// Sent in place of the listings when a batch request can't be answered, so the asking
+// peer can tell a request we rejected from one we never saw
+type cidBatchError struct {
+	Error *apiError `json:"error,omitempty"`
+}
+
+// Answers the stream with apiErr. Error frames are small, so they go out uncompressed.
+func writeCIDBatchError(s network.Stream, apiErr *apiError) {
+	data, err := json.Marshal(cidBatchError{Error: apiErr})
+	if err != nil {
+		log.Printf("Error encoding CID batch error: %v", err)
+		return
+	}
+	if err := writeEncoded(s, codecIdentity, data); err != nil {
+		log.Printf("Error writing CID batch error to stream: %v", err)
+	}
+}
+
+// Answers a cid-get 1.2.0 stream: one request line in, every match in one encoded response out
+func serveCIDBatch(node host.Host, s network.Stream) {
+	line, err := bufio.NewReader(io.LimitReader(s, maxCIDBatchRequestSize)).ReadBytes('\n')
+	switch {
+	case err == io.EOF && len(line) >= maxCIDBatchRequestSize:
+		log.Printf("Rejected CID batch request from %s: over %d bytes", s.Conn().RemotePeer(), maxCIDBatchRequestSize)
+		writeCIDBatchError(s, badRequest("request is over %d bytes", maxCIDBatchRequestSize))
+		return
+	case err == io.EOF && len(line) > 0:
+		// The peer finished writing without ending the line; what came may still parse
+	case err != nil:
+		log.Printf("Error reading CID batch request: %v", err)
+		return
+	}
+	var req cidBatchRequest
+	if err := json.Unmarshal(line, &req); err != nil {
+		log.Printf("Invalid CID batch request from %s: %v", s.Conn().RemotePeer(), err)
+		writeCIDBatchError(s, badRequest("invalid request: %v", err))
+		return
+	}
+	if err := req.validate(); err != nil {
+		log.Printf("Rejected CID batch request from %s: %v", s.Conn().RemotePeer(), err)
+		writeCIDBatchError(s, badRequest("%v", err))
+		return
+	}
+
+	matches, err := matchCatalog(req)
+	if err != nil {
+		log.Printf("Failed to search catalog: %v", err)
+		writeCIDBatchError(s, newAPIError(http.StatusInternalServerError, errCodeInternal, "failed to search catalog"))
+		return
+	}
+	responseBytes, err := json.Marshal(PeerIDs{
+		PeerID:   node.ID().String(),
+		NodeInfo: "Example Node Info",
+		Metadata: matches,
+	})
+	if err != nil {
+		log.Printf("Error encoding metadata response: %v", err)
+		return
+	}
+	codec := negotiateCodec(req.Codecs, len(responseBytes) >= minCompressibleSize)
+	if err := writeEncoded(s, codec, responseBytes); err != nil {
+		log.Printf("Error writing response to stream: %v", err)
+		return
+	}
+	log.Printf("Sent %d catalog entries in answer to a batch query from %s", len(matches), s.Conn().RemotePeer())
+}
+
+// queryPeerCatalog asks one peer for every listing matching req over a single stream.
+// Peers older than cid-get 1.2.0 can't answer and give an error. A request the peer
+// rejected comes back as a badRequest, anything else going wrong as upstreamFailed.
+func queryPeerCatalog(ctx context.Context, node host.Host, peerID peer.ID, req cidBatchRequest) (PeerIDs, error) {
+	var response PeerIDs
+	if err := req.validate(); err != nil {
+		return response, badRequest("%v", err)
+	}
+	query, err := encodeCIDBatchRequest(req)
+	if err != nil {
+		return response, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, providerQueryTimeout)
+	defer cancel()
+	s, err := node.NewStream(ctx, peerID, cidGetV1_2)
+	if err != nil {
+		return response, upstreamFailed("failed to open batch query stream to %s: %v", peerID, err)
+	}
+	defer s.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		s.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { s.Reset() })
+	defer stop()
+	recordNegotiated(peerID, "cid-get", s.Protocol())
+
+	if _, err := s.Write(query); err != nil {
+		return response, upstreamFailed("failed to send batch query: %v", contextOr(ctx, err))
+	}
+	data, err := readEncoded(s)
+	if err != nil {
+		return response, upstreamFailed("failed to read batch response: %v", contextOr(ctx, err))
+	}
+	var failure cidBatchError
+	if err := json.Unmarshal(data, &failure); err == nil && failure.Error != nil {
+		if failure.Error.Code == errCodeInvalidRequest {
+			return response, badRequest("%s rejected the query: %s", peerID, failure.Error.Message)
+		}
+		return response, upstreamFailed("%s failed to answer the query: %s", peerID, failure.Error.Message)
+	}
+	if err := json.Unmarshal(data, &response); err != nil {
+		return response, upstreamFailed("failed to decode batch response: %v", err)
+	}
+	return response, nil
+}
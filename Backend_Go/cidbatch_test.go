@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/multiformats/go-multibase"
+)
+
+// A request the server can't parse must come back as invalid_request, not a closed stream
+func TestCIDBatchRejectsInvalidRequest(t *testing.T) {
+	saved := catalog
+	defer func() { catalog = saved }()
+	catalog = openTestStore(t)
+
+	net, err := mocknet.FullMeshLinked(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer net.Close()
+	server, client := net.Hosts()[0], net.Hosts()[1]
+	server.SetStreamHandler(cidGetV1_2, func(s network.Stream) {
+		defer s.Close()
+		serveCIDBatch(server, s)
+	})
+
+	for name, request := range map[string]string{
+		"unparseable": "{not json\n",
+		"oversized":   `{"text":"` + strings.Repeat("x", maxCIDBatchRequestSize) + "\"}\n",
+	} {
+		s, err := client.NewStream(context.Background(), server.ID(), cidGetV1_2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go s.Write([]byte(request))
+		data, err := readEncoded(s)
+		s.Reset()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		var failure cidBatchError
+		if err := json.Unmarshal(data, &failure); err != nil || failure.Error == nil || failure.Error.Code != errCodeInvalidRequest {
+			t.Errorf("%s: got %s, want an invalid_request error", name, data)
+		}
+	}
+
+	if _, err := queryPeerCatalog(context.Background(), client, server.ID(), cidBatchRequest{Text: "x"}); err != nil {
+		t.Errorf("valid query failed: %v", err)
+	}
+}
+
+// Peers may spell a listed CID in another multibase; it must still be found
+func TestMatchCatalogCanonicalizesCIDs(t *testing.T) {
+	saved := catalog
+	defer func() { catalog = saved }()
+	catalog = openTestStore(t)
+
+	c, err := defaultCIDOptions.sum([]byte("content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := catalog.Add(FileMetadata{CID: c.String(), FilePath: "/shared/content"}); err != nil {
+		t.Fatal(err)
+	}
+	base58, err := c.StringOfBase(multibase.Base58BTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	matches, err := matchCatalog(cidBatchRequest{CIDs: []string{base58, strings.ToUpper(c.String())}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 1 || matches[0].CID != c.String() {
+		t.Errorf("got %+v, want the entry for %s once", matches, c)
+	}
+}
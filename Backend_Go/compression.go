@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Stream codecs, in order of preference
+const (
+	codecZstd     = "zstd"
+	codecGzip     = "gzip"
+	codecIdentity = "identity"
+)
+
+var supportedCodecs = []string{codecZstd, codecGzip, codecIdentity}
+
+const (
+	compressionSampleSize  = 64 * 1024 // bytes sampled to decide whether a file is worth compressing
+	maxCompressibleEntropy = 7.5       // bits per byte; above this the data is effectively random
+	minCompressibleSize    = 512       // payloads smaller than this aren't worth the codec overhead
+
+	// Largest metadata response we read from a peer, after decompression. A few bytes
+	// of zstd can expand to gigabytes, so the limit applies to the decoded data.
+	maxMetadataResponseSize = 16 << 20
+)
+
+// Content types that are already compressed and gain nothing from another pass
+var precompressedTypes = []string{
+	"image/jpeg", "image/png", "image/gif", "image/webp", "image/avif", "image/heic",
+	"video/", "audio/mpeg", "audio/ogg", "audio/aac", "audio/mp4", "audio/webm", "audio/flac",
+	"application/zip", "application/gzip", "application/x-gzip", "application/zstd",
+	"application/x-7z-compressed", "application/x-rar-compressed", "application/vnd.rar",
+	"application/x-xz", "application/x-bzip2", "application/pdf",
+	"application/vnd.openxmlformats-officedocument.",
+}
+
+// Formats the codec list a client offers, e.g. "zstd gzip identity"
+func acceptedCodecs() string {
+	return strings.Join(supportedCodecs, " ")
+}
+
+// negotiateCodec picks our most preferred codec that the peer also offered.
+// identity is always acceptable, so the result is never empty.
+func negotiateCodec(offered string, compressible bool) string {
+	if !compressible {
+		return codecIdentity
+	}
+	peerCodecs := strings.Fields(offered)
+	for _, ours := range supportedCodecs {
+		for _, theirs := range peerCodecs {
+			if ours == theirs {
+				return ours
+			}
+		}
+	}
+	return codecIdentity
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+// Wraps w so that writes are encoded with codec. Close flushes the encoder but not w.
+func newCompressWriter(codec string, w io.Writer) (io.WriteCloser, error) {
+	switch codec {
+	case codecZstd:
+		return zstd.NewWriter(w)
+	case codecGzip:
+		return gzip.NewWriter(w), nil
+	case codecIdentity, "":
+		return nopWriteCloser{w}, nil
+	}
+	return nil, fmt.Errorf("unsupported codec: %s", codec)
+}
+
+// Wraps r so that reads are decoded with codec
+func newDecompressReader(codec string, r io.Reader) (io.ReadCloser, error) {
+	switch codec {
+	case codecZstd:
+		dec, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return dec.IOReadCloser(), nil
+	case codecGzip:
+		return gzip.NewReader(r)
+	case codecIdentity, "":
+		return io.NopCloser(r), nil
+	}
+	return nil, fmt.Errorf("unsupported codec: %s", codec)
+}
+
+// Reads the codec header line a server sends ahead of a negotiated payload
+func readCodecHeader(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", fmt.Errorf("failed to read codec header: %w", err)
+	}
+	codec := strings.TrimSpace(line)
+	if !isSupportedCodec(codec) {
+		return "", fmt.Errorf("peer chose unsupported codec: %q", codec)
+	}
+	return codec, nil
+}
+
+func isSupportedCodec(codec string) bool {
+	for _, c := range supportedCodecs {
+		if c == codec {
+			return true
+		}
+	}
+	return false
+}
+
+func isPrecompressedType(contentType string) bool {
+	contentType, _, _ = mime.ParseMediaType(contentType)
+	for _, t := range precompressedTypes {
+		if strings.HasPrefix(contentType, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// Shannon entropy of the sample in bits per byte
+func sampleEntropy(sample []byte) float64 {
+	if len(sample) == 0 {
+		return 0
+	}
+	var counts [256]int
+	for _, b := range sample {
+		counts[b]++
+	}
+	entropy := 0.0
+	total := float64(len(sample))
+	for _, c := range counts {
+		if c == 0 {
+			continue
+		}
+		p := float64(c) / total
+		entropy -= p * math.Log2(p)
+	}
+	return entropy
+}
+
+// shouldCompressFile decides whether a file is worth compressing on the wire, first
+// by its MIME type and then by the entropy of a sample from the start of the file.
+func shouldCompressFile(path string) bool {
+	if isPrecompressedType(mime.TypeByExtension(filepath.Ext(path))) {
+		return false
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	sample := make([]byte, compressionSampleSize)
+	n, err := io.ReadFull(file, sample)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return false
+	}
+	sample = sample[:n]
+	if n < minCompressibleSize {
+		return false
+	}
+	if isPrecompressedType(http.DetectContentType(sample)) {
+		return false
+	}
+	return sampleEntropy(sample) <= maxCompressibleEntropy
+}
+
+// Writes the codec header line followed by payload encoded with codec
+func writeEncoded(w io.Writer, codec string, payload []byte) error {
+	if _, err := w.Write([]byte(codec + "\n")); err != nil {
+		return err
+	}
+	cw, err := newCompressWriter(codec, w)
+	if err != nil {
+		return err
+	}
+	if _, err := cw.Write(payload); err != nil {
+		return err
+	}
+	return cw.Close()
+}
+
+// Reads all of r, failing once it goes past limit bytes
+func readAllLimited(r io.Reader, limit int64) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("response is larger than %d bytes", limit)
+	}
+	return data, nil
+}
+
+// Reads a payload written by writeEncoded until the end of the stream, up to
+// maxMetadataResponseSize decoded bytes
+func readEncoded(r io.Reader) ([]byte, error) {
+	reader := bufio.NewReader(r)
+	codec, err := readCodecHeader(reader)
+	if err != nil {
+		return nil, err
+	}
+	body, err := newDecompressReader(codec, reader)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return readAllLimited(body, maxMetadataResponseSize)
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestReadEncodedRoundTrip(t *testing.T) {
+	payload := bytes.Repeat([]byte(`{"cid":"x"}`), 1000)
+	for _, codec := range supportedCodecs {
+		var buf bytes.Buffer
+		if err := writeEncoded(&buf, codec, payload); err != nil {
+			t.Fatalf("%s: %v", codec, err)
+		}
+		got, err := readEncoded(&buf)
+		if err != nil {
+			t.Fatalf("%s: %v", codec, err)
+		}
+		if !bytes.Equal(got, payload) {
+			t.Errorf("%s: payload changed on the way through", codec)
+		}
+	}
+}
+
+// A small compressed response that decodes past the limit must be refused, not buffered
+func TestReadEncodedLimit(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeEncoded(&buf, codecZstd, make([]byte, maxMetadataResponseSize+1)); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() > 1<<20 {
+		t.Fatalf("expected the zeros to compress, got %d bytes", buf.Len())
+	}
+	if _, err := readEncoded(&buf); err == nil {
+		t.Error("read a response past maxMetadataResponseSize")
+	}
+}
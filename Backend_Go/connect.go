@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// Connection paths reported for a transfer
+const (
+	pathDirect      = "direct"
+	pathHolePunched = "hole-punched"
+	pathRelay       = "relay"
+)
+
+var (
+	directDialTimeout = 10 * time.Second // per attempt on known direct addresses
+	peerLookupTimeout = 15 * time.Second // DHT FindPeer lookup
+	holePunchTimeout  = 30 * time.Second // how long to wait for DCUtR to upgrade a relayed connection
+)
+
+func isRelayedAddr(addr multiaddr.Multiaddr) bool {
+	_, err := addr.ValueForProtocol(multiaddr.P_CIRCUIT)
+	return err == nil
+}
+
+// Returns only the addresses that can be dialed without going through a relay
+func directAddrs(addrs []multiaddr.Multiaddr) []multiaddr.Multiaddr {
+	var direct []multiaddr.Multiaddr
+	for _, addr := range addrs {
+		if !isRelayedAddr(addr) {
+			direct = append(direct, addr)
+		}
+	}
+	return direct
+}
+
+func hasDirectConn(node host.Host, p peer.ID) bool {
+	for _, conn := range node.Network().ConnsToPeer(p) {
+		if !conn.Stat().Limited && !isRelayedAddr(conn.RemoteMultiaddr()) {
+			return true
+		}
+	}
+	return false
+}
+
+func tryDirectConnect(ctx context.Context, node host.Host, info peer.AddrInfo) error {
+	dialCtx, cancel := context.WithTimeout(ctx, directDialTimeout)
+	defer cancel()
+	// Force a direct dial so an existing relayed connection doesn't short-circuit Connect
+	dialCtx = network.WithForceDirectDial(dialCtx, "prefer direct")
+	return node.Connect(dialCtx, info)
+}
+
+// Hole-punch watches in flight, so repeated relay connects to one peer share one,
+// and the peers whose direct connection came from hole punching
+var directUpgrades = struct {
+	sync.Mutex
+	inFlight    map[peer.ID]bool
+	holePunched map[peer.ID]bool
+}{inFlight: make(map[peer.ID]bool), holePunched: make(map[peer.ID]bool)}
+
+// The path an existing direct connection to the peer was set up over
+func directPath(p peer.ID) string {
+	directUpgrades.Lock()
+	defer directUpgrades.Unlock()
+	if directUpgrades.holePunched[p] {
+		return pathHolePunched
+	}
+	return pathDirect
+}
+
+// watchHolePunch gives DCUtR time to upgrade a relayed connection to the peer in the
+// background, recording whether it did so later streams are reported correctly
+func watchHolePunch(node host.Host, p peer.ID) {
+	directUpgrades.Lock()
+	defer directUpgrades.Unlock()
+	if directUpgrades.inFlight[p] {
+		return
+	}
+	directUpgrades.inFlight[p] = true
+
+	go func() {
+		// Not tied to any one request: the connection outlives the transfer that asked for it
+		holePunched := waitForDirectConn(globalCtx, node, p, holePunchTimeout)
+		if holePunched {
+			log.Printf("Hole punching upgraded the connection to %s", p)
+		}
+		directUpgrades.Lock()
+		directUpgrades.holePunched[p] = holePunched
+		delete(directUpgrades.inFlight, p)
+		directUpgrades.Unlock()
+	}()
+}
+
+// Dials the peer's known direct addresses, then the ones the DHT has, reporting
+// whether we ended up with a direct connection
+func dialDirect(ctx context.Context, node host.Host, kadDHT *dht.IpfsDHT, p peer.ID) bool {
+	// Step 1: Addresses we already know about
+	if addrs := directAddrs(node.Peerstore().Addrs(p)); len(addrs) > 0 {
+		err := tryDirectConnect(ctx, node, peer.AddrInfo{ID: p, Addrs: addrs})
+		if err == nil && hasDirectConn(node, p) {
+			return true
+		}
+		log.Printf("Direct dial to %s from peerstore failed: %v", p, err)
+	}
+
+	// Step 2: Addresses advertised in the DHT
+	if kadDHT != nil {
+		lookupCtx, cancel := context.WithTimeout(ctx, peerLookupTimeout)
+		info, err := kadDHT.FindPeer(lookupCtx, p)
+		cancel()
+		if err != nil {
+			log.Printf("DHT lookup for %s failed: %v", p, err)
+		} else if addrs := directAddrs(info.Addrs); len(addrs) > 0 {
+			err = tryDirectConnect(ctx, node, peer.AddrInfo{ID: p, Addrs: addrs})
+			if err == nil && hasDirectConn(node, p) {
+				return true
+			}
+			log.Printf("Direct dial to %s from DHT addresses failed: %v", p, err)
+		}
+	}
+	return false
+}
+
+// connectToPeerPreferDirect connects to the target peer over the best path available.
+// It dials the direct addresses already in the peerstore, then the ones the DHT knows
+// about, and only when all of them fail falls back to the relay, leaving DCUtR to
+// upgrade the relayed connection in the background. It returns the path streams
+// opened now will take.
+func connectToPeerPreferDirect(ctx context.Context, node host.Host, kadDHT *dht.IpfsDHT, targetPeerID peer.ID) (string, error) {
+	if hasDirectConn(node, targetPeerID) {
+		return directPath(targetPeerID), nil
+	}
+	if dialDirect(ctx, node, kadDHT, targetPeerID) {
+		directUpgrades.Lock()
+		delete(directUpgrades.holePunched, targetPeerID)
+		directUpgrades.Unlock()
+		return pathDirect, nil
+	}
+
+	// Fall back to the relay, unless we're already connected through it
+	if len(node.Network().ConnsToPeer(targetPeerID)) == 0 {
+		if err := connectToPeerUsingRelay(node, targetPeerID.String()); err != nil {
+			return "", err
+		}
+	}
+	watchHolePunch(node, targetPeerID)
+	return pathRelay, nil
+}
+
+func waitForDirectConn(ctx context.Context, node host.Host, p peer.ID, timeout time.Duration) bool {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(250 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		if hasDirectConn(node, p) {
+			return true
+		}
+		select {
+		case <-ticker.C:
+		case <-deadline.C:
+			return false
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// streamPath reports the path a stream actually runs over. connectPath is what
+// connectToPeerPreferDirect returned; a direct stream may also come from an upgrade
+// that finished since.
+func streamPath(s network.Stream, connectPath string) string {
+	if s.Conn().Stat().Limited || isRelayedAddr(s.Conn().RemoteMultiaddr()) {
+		return pathRelay
+	}
+	if connectPath == pathHolePunched {
+		return pathHolePunched
+	}
+	return directPath(s.Conn().RemotePeer())
+}
+
+func parsePeerID(targetPeerID string) (peer.ID, error) {
+	id, err := peer.Decode(strings.TrimSpace(targetPeerID))
+	if err != nil {
+		return "", fmt.Errorf("invalid peer ID %q: %w", targetPeerID, err)
+	}
+	return id, nil
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const (
+	providerLookupTimeout = 30 * time.Second
+
+	// How long a gateway fetch may keep filling the cache after its viewers have gone
+	gatewayFillTimeout = time.Hour
+)
+
+// Directory the content gateway caches fetched files in
+func getContentCacheDir() (string, error) {
+	downloadPath, err := getDownloadPath()
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(downloadPath, node_id+"-cache")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create cache directory: %w", err)
+	}
+	return dir, nil
+}
+
+// contentFetch tracks a download that the gateway is serving while it is still
+// being written, so readers can wait for the bytes they need.
+type contentFetch struct {
+	mu       sync.Mutex
+	path     string // the part file, then the cached file once the fetch succeeds
+	final    string // the cached file
+	mimeType string // from the provider's listing, if it gave one
+	written  int64
+	done     bool
+	err      error
+	changed  chan struct{} // closed and replaced on every update
+}
+
+func newContentFetch(cachePath string) *contentFetch {
+	return &contentFetch{path: downloadPartPath(cachePath), final: cachePath, changed: make(chan struct{})}
+}
+
+func (f *contentFetch) update(written int64, done bool, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.written = written
+	f.done = done
+	f.err = err
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+// Opens the content as far as it has been written. fetchFromPeer moves the part file
+// to the cached path once it checks out, which may happen before finish is called.
+func (f *contentFetch) open() (*os.File, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	file, err := os.Open(f.path)
+	if os.IsNotExist(err) && f.path != f.final {
+		return os.Open(f.final)
+	}
+	return file, err
+}
+
+// Ends the fetch; a successful download is at the cached path from then on
+func (f *contentFetch) finish(written int64, err error) {
+	f.mu.Lock()
+	if err == nil {
+		f.path = f.final
+	}
+	f.mu.Unlock()
+	f.update(written, true, err)
+}
+
+func (f *contentFetch) progress(written int64) {
+	f.mu.Lock()
+	done, err := f.done, f.err
+	f.mu.Unlock()
+	f.update(written, done, err)
+}
+
+// waitFor blocks until at least n bytes are on disk or the fetch has ended.
+func (f *contentFetch) waitFor(ctx context.Context, n int64) (int64, bool, error) {
+	for {
+		f.mu.Lock()
+		written, done, err, changed := f.written, f.done, f.err, f.changed
+		f.mu.Unlock()
+		if written >= n || done {
+			return written, done, err
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return written, false, ctx.Err()
+		}
+	}
+}
+
+var (
+	contentFetchesMu sync.Mutex
+	contentFetches   = make(map[string]*contentFetch)
+)
+
+// Starts fetching cid into the gateway cache, or joins the fetch already running
+func (h *dhtHandler) startContentFetch(cidStr, cachePath string, provider peer.ID) *contentFetch {
+	contentFetchesMu.Lock()
+	defer contentFetchesMu.Unlock()
+	if f, ok := contentFetches[cidStr]; ok {
+		return f
+	}
+
+	f := newContentFetch(cachePath)
+	contentFetches[cidStr] = f
+
+	go func() {
+		// Not tied to the request that started it: the download keeps going after the
+		// viewer goes away so the cache is populated, but not for longer than gatewayFillTimeout
+		ctx, cancel := context.WithTimeout(globalCtx, gatewayFillTimeout)
+		defer cancel()
+
+		// The provider's listing tells us the content type, which sniffing only guesses at
+		listing := queryCIDFromPeer(ctx, h.node, provider, cidStr)
+		for _, metadata := range listing.Metadata {
+			if metadata.CID == cidStr && metadata.MimeType != "" {
+				f.mu.Lock()
+				f.mimeType = metadata.MimeType
+				f.mu.Unlock()
+				break
+			}
+		}
+
+		result, err := h.fetchFromPeer(ctx, provider, cidStr, cachePath, f.progress)
+		if err == nil && result.Locked != nil {
+			err = fmt.Errorf("content is paid and has to be unlocked before it can be viewed")
+			os.Remove(result.Locked.LockedPath)
+			catalog.RemoveLockedDownload(result.Locked.TransferID)
+		}
+		f.finish(result.Written, err)
+		if err == nil {
+			h.cacheGatewayDownload(cidStr, cachePath)
+		} else {
+			log.Printf("Gateway fetch of %s from %s failed: %v", cidStr, provider, err)
+		}
+
+		contentFetchesMu.Lock()
+		delete(contentFetches, cidStr)
+		contentFetchesMu.Unlock()
+	}()
+	return f
+}
+
+// Finds a provider for c other than ourselves
+func (h *dhtHandler) findProviderPeer(ctx context.Context, c cid.Cid) (peer.ID, error) {
+	ctx, cancel := context.WithTimeout(ctx, providerLookupTimeout)
+	defer cancel()
+	for p := range h.kadDHT.FindProvidersAsync(ctx, c, 0) {
+		if p.ID != "" && p.ID != h.node.ID() {
+			return p.ID, nil
+		}
+	}
+	return "", fmt.Errorf("no providers found for %s", c)
+}
+
+// Looks for a complete local copy of the content: a file we share or one already cached.
+// A shared file that no longer passes its integrity check isn't that content any more,
+// just as it isn't for peers, so the cache is tried instead.
+func localContentPath(cidStr, cachePath string) (string, bool) {
+	if metadata, ok := catalog.Get(cidStr); ok && servableIntegrity(metadata) {
+		return metadata.FilePath, true
+	}
+	if _, err := os.Stat(cachePath); err == nil {
+		if downloadCache != nil {
+			downloadCache.Touch(cidStr)
+		}
+		return cachePath, true
+	}
+	return "", false
+}
+
+// Handler that streams content straight into the response, from a local copy when
+// there is one and from a provider otherwise. Range requests are supported either way,
+// so the UI can start playing media before the download has finished.
+func (h *dhtHandler) contentGatewayHandler(w http.ResponseWriter, r *http.Request) {
+	// Set CORS headers
+	w.Header().Set("Access-Control-Allow-Origin", "http://localhost:5173") // Change to your frontend's URL
+	w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Range")
+	w.Header().Set("Access-Control-Expose-Headers", "Content-Range, Content-Length, Accept-Ranges")
+
+	// Handle preflight OPTIONS request
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	cidStr := mux.Vars(r)["cid"]
+	c, err := cid.Decode(cidStr)
+	if err != nil {
+		http.Error(w, "Invalid CID", http.StatusBadRequest)
+		return
+	}
+	cidStr = c.String()
+
+	cacheDir, err := getContentCacheDir()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	cachePath := filepath.Join(cacheDir, cidStr)
+
+	if path, ok := localContentPath(cidStr, cachePath); ok {
+		metadata, _ := catalog.Get(cidStr)
+		serveLocalContent(w, r, path, metadata.MimeType)
+		return
+	}
+
+	if r.Method == http.MethodHead {
+		h.headRemoteContent(w, r, cidStr)
+		return
+	}
+
+	var provider peer.ID
+	if p := r.URL.Query().Get("peer"); p != "" {
+		provider, err = parsePeerID(p)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else {
+		provider, err = h.findProviderPeer(r.Context(), c)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+	}
+
+	f := h.startContentFetch(cidStr, cachePath, provider)
+	serveGrowingContent(w, r, f)
+}
+
+// Answers HEAD for content we don't have from the provider's listing, without
+// starting a transfer
+func (h *dhtHandler) headRemoteContent(w http.ResponseWriter, r *http.Request, cidStr string) {
+	var provider peer.ID
+	var err error
+	if p := r.URL.Query().Get("peer"); p != "" {
+		if provider, err = parsePeerID(p); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	} else {
+		c, _ := cid.Decode(cidStr)
+		if provider, err = h.findProviderPeer(r.Context(), c); err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+	}
+	listing := queryCIDFromPeer(r.Context(), h.node, provider, cidStr)
+	for _, metadata := range listing.Metadata {
+		if metadata.CID != cidStr {
+			continue
+		}
+		if metadata.MimeType != "" {
+			w.Header().Set("Content-Type", metadata.MimeType)
+		}
+		if metadata.Size > 0 {
+			w.Header().Set("Content-Length", strconv.FormatInt(metadata.Size, 10))
+		}
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	w.WriteHeader(http.StatusNotFound)
+}
+
+// Serves a complete file, as mimeType when the catalog knows it
+func serveLocalContent(w http.ResponseWriter, r *http.Request, path, mimeType string) {
+	file, err := os.Open(path)
+	if err != nil {
+		http.Error(w, "Content unavailable", http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		http.Error(w, "Content unavailable", http.StatusNotFound)
+		return
+	}
+	if mimeType != "" {
+		w.Header().Set("Content-Type", mimeType)
+	}
+	// ServeContent handles Range, If-Range and, unless set above, picks the Content-Type from the name or by sniffing
+	http.ServeContent(w, r, filepath.Base(path), info.ModTime(), file)
+}
+
+// Parses a single "bytes=start-end" range. end is -1 when open-ended; suffix ranges aren't
+// supported while the total size is still unknown.
+func parseByteRange(header string) (start, end int64, ok bool) {
+	spec, found := strings.CutPrefix(header, "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return 0, 0, false
+	}
+	startStr, endStr, found := strings.Cut(spec, "-")
+	if !found || startStr == "" {
+		return 0, 0, false
+	}
+	start, err := strconv.ParseInt(startStr, 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, false
+	}
+	end = -1
+	if endStr != "" {
+		end, err = strconv.ParseInt(endStr, 10, 64)
+		if err != nil || end < start {
+			return 0, 0, false
+		}
+	}
+	return start, end, true
+}
+
+// Serves a file that is still being downloaded. Range responses only cover the bytes
+// already on disk and use "*" as the total until the size is known.
+func serveGrowingContent(w http.ResponseWriter, r *http.Request, f *contentFetch) {
+	ctx := r.Context()
+
+	// Wait for enough of the file to sniff its type, in case the listing didn't say
+	written, _, err := f.waitFor(ctx, 512)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	file, err := f.open()
+	if err != nil {
+		http.Error(w, "Content unavailable", http.StatusBadGateway)
+		return
+	}
+	defer file.Close()
+
+	f.mu.Lock()
+	mimeType := f.mimeType
+	f.mu.Unlock()
+	if mimeType == "" {
+		sniff := make([]byte, min(written, 512))
+		n, _ := io.ReadFull(file, sniff)
+		mimeType = http.DetectContentType(sniff[:n])
+	}
+	w.Header().Set("Content-Type", mimeType)
+	w.Header().Set("Accept-Ranges", "bytes")
+
+	start, end, isRange := parseByteRange(r.Header.Get("Range"))
+	if !isRange {
+		// Whole file: stream it as it arrives
+		w.WriteHeader(http.StatusOK)
+		copyGrowing(ctx, w, file, f, 0, -1)
+		return
+	}
+
+	written, done, err := f.waitFor(ctx, start+1)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	if start >= written {
+		if done {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", written))
+		}
+		http.Error(w, "Requested range not satisfiable", http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+	if end < 0 || end >= written {
+		end = written - 1
+	}
+	total := "*"
+	if done {
+		total = strconv.FormatInt(written, 10)
+	}
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%s", start, end, total))
+	w.Header().Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+	w.WriteHeader(http.StatusPartialContent)
+	copyGrowing(ctx, w, file, f, start, end)
+}
+
+// Copies file[start:end] (end inclusive, -1 for until the fetch ends) into w, waiting
+// for the fetch to write more whenever it catches up.
+func copyGrowing(ctx context.Context, w http.ResponseWriter, file *os.File, f *contentFetch, start, end int64) {
+	flusher, _ := w.(http.Flusher)
+	buf := make([]byte, 32*1024)
+	offset := start
+	for end < 0 || offset <= end {
+		written, done, err := f.waitFor(ctx, offset+1)
+		if err != nil || offset >= written {
+			return
+		}
+		limit := written
+		if end >= 0 && end+1 < limit {
+			limit = end + 1
+		}
+		for offset < limit {
+			chunk := buf[:min(int64(len(buf)), limit-offset)]
+			n, err := file.ReadAt(chunk, offset)
+			if n > 0 {
+				if _, werr := w.Write(chunk[:n]); werr != nil {
+					return
+				}
+				offset += int64(n)
+			}
+			if err != nil && err != io.EOF {
+				return
+			}
+			if n == 0 {
+				break
+			}
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		if done && offset >= written {
+			return
+		}
+	}
+}
+
+func init() {
+	// Make sure common media types resolve even on systems without a mime database
+	mime.AddExtensionType(".mp4", "video/mp4")
+	mime.AddExtensionType(".webm", "video/webm")
+	mime.AddExtensionType(".mp3", "audio/mpeg")
+	mime.AddExtensionType(".ogg", "audio/ogg")
+}
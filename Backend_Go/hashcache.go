@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	bolt "go.etcd.io/bbolt"
+)
+
+// A CID computed earlier for a file, valid while the file still has this size,
+// modification time and inode
+type hashCacheEntry struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	Inode   uint64    `json:"inode"`
+	CID     string    `json:"cid"`
+}
+
+// Entries are keyed by path and addressing, since one file has a different CID per option set
+func hashCacheKey(path string, opts cidOptions) []byte {
+	return []byte(fmt.Sprintf("%s\x00%s/%d/%s", path, opts.Hash, opts.Version, opts.Codec))
+}
+
+func (ms *metadataStore) cachedHash(key []byte) (hashCacheEntry, bool) {
+	var entry hashCacheEntry
+	found := false
+	ms.db.View(func(tx *bolt.Tx) error {
+		if data := tx.Bucket(hashCacheBucket).Get(key); data != nil {
+			found = json.Unmarshal(data, &entry) == nil
+		}
+		return nil
+	})
+	return entry, found
+}
+
+func (ms *metadataStore) putCachedHash(key []byte, entry hashCacheEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return ms.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(hashCacheBucket).Put(key, data)
+	})
+}
+
+// Drops every cached CID for path, under any addressing options
+func (ms *metadataStore) forgetCachedHashes(path string) error {
+	prefix := []byte(path + "\x00")
+	return ms.db.Update(func(tx *bolt.Tx) error {
+		c := tx.Bucket(hashCacheBucket).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Seek(prefix) {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// cachedFileCID returns the file's CID under opts, reusing the one computed last time
+// if the file's size, mtime and inode haven't changed. force skips the cache and
+// rehashes. Downloads are always verified with verifyFileCID instead, which never
+// trusts the cache.
+func cachedFileCID(filePath string, opts cidOptions, force bool, onProgress func(int64)) (cid.Cid, error) {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		// Nothing cached for a file that's gone is ever going to be valid again
+		if errors.Is(err, fs.ErrNotExist) {
+			catalog.forgetCachedHashes(filePath)
+		}
+		return cid.Undef, fmt.Errorf("failed to open file: %w", err)
+	}
+	key := hashCacheKey(filePath, opts)
+	if !force {
+		if entry, ok := catalog.cachedHash(key); ok && entry.Size == info.Size() &&
+			entry.ModTime.Equal(info.ModTime()) && entry.Inode == fileInode(info) {
+			if c, err := cid.Decode(entry.CID); err == nil {
+				return c, nil
+			}
+		}
+	}
+
+	c, err := hashFileWithProgress(filePath, opts, onProgress)
+	if err != nil {
+		return cid.Undef, err
+	}
+	// Only cache the result if the file didn't change while we were reading it
+	after, err := os.Stat(filePath)
+	if err == nil && after.Size() == info.Size() && after.ModTime().Equal(info.ModTime()) {
+		rememberFileCID(filePath, opts, info, c)
+	}
+	return c, nil
+}
+
+// Records c as the CID of the file as described by info, for files whose CID was
+// worked out some other way than reading them back, such as uploads hashed on the way in
+func rememberFileCID(filePath string, opts cidOptions, info os.FileInfo, c cid.Cid) {
+	entry := hashCacheEntry{Size: info.Size(), ModTime: info.ModTime(), Inode: fileInode(info), CID: c.String()}
+	if err := catalog.putCachedHash(hashCacheKey(filePath, opts), entry); err != nil {
+		log.Printf("Failed to cache hash of %s: %v", filePath, err)
+	}
+}
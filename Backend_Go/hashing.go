@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+)
+
+const (
+	hashChunkSize = 1 << 20 // 1 MiB read buffer for streaming hashes
+
+	// How long a finished hash stays visible to progress queries
+	hashProgressRetention = 10 * time.Minute
+
+	cidOptionsSetting = "cid_options"
+)
+
+// cidOptions selects how content is addressed: the multihash function plus the CID
+// version and codec. The node default is kept in settings and single advertisements
+// can override it.
+type cidOptions struct {
+	Hash    string `json:"hash"`    // sha2-256, sha2-512 or blake3
+	Version int    `json:"version"` // 1, or 0 for dag-pb with sha2-256
+	Codec   string `json:"codec"`   // raw, or dag-pb for IPFS-compatible UnixFS CIDs
+}
+
+// What every node used before addressing became configurable
+var defaultCIDOptions = cidOptions{Hash: "sha2-256", Version: 1, Codec: "raw"}
+
+var supportedHashes = map[string]uint64{
+	"sha2-256": multihash.SHA2_256,
+	"sha2-512": multihash.SHA2_512,
+	"blake3":   multihash.BLAKE3,
+}
+
+var supportedCIDCodecs = map[string]uint64{
+	"raw":    cid.Raw,
+	"dag-pb": cid.DagProtobuf, // UnixFS DAG, as built by `ipfs add`
+}
+
+var errCIDMismatch = errors.New("content does not match CID")
+
+func (o cidOptions) validate() error {
+	if _, ok := supportedHashes[o.Hash]; !ok {
+		return fmt.Errorf("unsupported hash function %q", o.Hash)
+	}
+	if _, ok := supportedCIDCodecs[o.Codec]; !ok {
+		return fmt.Errorf("unsupported CID codec %q", o.Codec)
+	}
+	switch o.Version {
+	case 1:
+	case 0:
+		// CIDv0 implies dag-pb and sha2-256
+		if o.Codec != "dag-pb" || o.Hash != "sha2-256" {
+			return fmt.Errorf("CID version 0 needs the dag-pb codec and sha2-256")
+		}
+	default:
+		return fmt.Errorf("unsupported CID version %d", o.Version)
+	}
+	return nil
+}
+
+func (o cidOptions) cidFor(mh multihash.Multihash) cid.Cid {
+	if o.Version == 0 {
+		return cid.NewCidV0(mh)
+	}
+	return cid.NewCidV1(supportedCIDCodecs[o.Codec], mh)
+}
+
+// Addresses an in-memory blob, for things like manifests
+func (o cidOptions) sum(data []byte) (cid.Cid, error) {
+	if err := o.validate(); err != nil {
+		return cid.Undef, err
+	}
+	if o.Codec == "dag-pb" {
+		return unixfsCID(bytes.NewReader(data), o)
+	}
+	mh, err := multihash.Sum(data, supportedHashes[o.Hash], -1)
+	if err != nil {
+		return cid.Undef, err
+	}
+	return o.cidFor(mh), nil
+}
+
+// Works out the options that produce CIDs like c, so content can be checked against it
+func cidOptionsFor(c cid.Cid) (cidOptions, error) {
+	prefix := c.Prefix()
+	opts := cidOptions{Version: int(prefix.Version)}
+	for name, code := range supportedHashes {
+		if code == prefix.MhType {
+			opts.Hash = name
+		}
+	}
+	for name, code := range supportedCIDCodecs {
+		if code == prefix.Codec {
+			opts.Codec = name
+		}
+	}
+	if opts.Hash == "" {
+		return opts, fmt.Errorf("CID %s uses an unsupported hash function", c)
+	}
+	if opts.Codec == "" {
+		return opts, fmt.Errorf("CID %s uses an unsupported codec", c)
+	}
+	return opts, opts.validate()
+}
+
+// The node's default addressing
+func nodeCIDOptions() cidOptions {
+	opts := defaultCIDOptions
+	if found, err := catalog.Setting(cidOptionsSetting, &opts); err != nil || !found || opts.validate() != nil {
+		return defaultCIDOptions
+	}
+	return opts
+}
+
+// Changes to the node's default addressing asked for by one request. Mode "unixfs"
+// starts from the `ipfs add` defaults and "raw" from the original ones.
+type cidOverrides struct {
+	Mode    string `json:"mode,omitempty"`
+	Hash    string `json:"hash,omitempty"`
+	Version *int   `json:"cidversion,omitempty"`
+	Codec   string `json:"codec,omitempty"`
+}
+
+func (o cidOverrides) resolve() (cidOptions, error) {
+	opts := nodeCIDOptions()
+	switch o.Mode {
+	case "":
+	case "unixfs":
+		opts = unixfsCIDOptions
+	case "raw":
+		opts = defaultCIDOptions
+	default:
+		return opts, fmt.Errorf("unknown import mode %q", o.Mode)
+	}
+	if o.Hash != "" {
+		opts.Hash = o.Hash
+	}
+	if o.Version != nil {
+		opts.Version = *o.Version
+	}
+	if o.Codec != "" {
+		opts.Codec = o.Codec
+	}
+	return opts, opts.validate()
+}
+
+// Reads ?mode=, ?hash=, ?cidversion= and ?codec=
+func cidOverridesFromQuery(query url.Values) (cidOverrides, error) {
+	o := cidOverrides{Mode: query.Get("mode"), Hash: query.Get("hash"), Codec: query.Get("codec")}
+	if v := query.Get("cidversion"); v != "" {
+		version, err := strconv.Atoi(v)
+		if err != nil {
+			return o, fmt.Errorf("invalid cidversion %q", v)
+		}
+		o.Version = &version
+	}
+	return o, nil
+}
+
+// Starts from the node default and applies the query's overrides
+func cidOptionsFromQuery(query url.Values) (cidOptions, error) {
+	o, err := cidOverridesFromQuery(query)
+	if err != nil {
+		return cidOptions{}, err
+	}
+	return o.resolve()
+}
+
+// Makes the overrides the node's new default addressing
+func saveCIDSettings(o cidOverrides) (cidOptions, error) {
+	opts, err := o.resolve()
+	if err != nil {
+		return opts, badRequest("%v", err)
+	}
+	if err := catalog.PutSetting(cidOptionsSetting, opts); err != nil {
+		return opts, err
+	}
+	return opts, nil
+}
+
+// verifyFileCID checks the file against cidStr, hashing it with whatever multihash
+// and codec the CID names. Content that hashes differently gives errCIDMismatch.
+func verifyFileCID(path, cidStr string) error {
+	expected, err := cid.Decode(cidStr)
+	if err != nil {
+		return fmt.Errorf("invalid CID %q: %w", cidStr, err)
+	}
+	opts, err := cidOptionsFor(expected)
+	if err != nil {
+		return err
+	}
+	got, err := hashFileWithProgress(path, opts, nil)
+	if err != nil {
+		return err
+	}
+	if !got.Equals(expected) {
+		return fmt.Errorf("%w: got %s, expected %s", errCIDMismatch, got, expected)
+	}
+	return nil
+}
+
+// Progress of hashing one file, as reported by GET /advertise/progress
+type hashProgress struct {
+	Path       string    `json:"path"`
+	Hashed     int64     `json:"hashed"`
+	Total      int64     `json:"total"`
+	Done       bool      `json:"done"`
+	CID        string    `json:"cid,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	FinishedAt time.Time `json:"-"`
+}
+
+var hashJobs = struct {
+	sync.Mutex
+	byPath map[string]*hashProgress
+}{byPath: make(map[string]*hashProgress)}
+
+// hashFileTracked hashes the file like cachedFileCID while publishing its progress
+// under the file's path, so the UI can poll it during long advertisements.
+func hashFileTracked(filePath string, total int64, opts cidOptions, force bool) (cid.Cid, error) {
+	progress := &hashProgress{Path: filePath, Total: total}
+	hashJobs.Lock()
+	for path, job := range hashJobs.byPath {
+		if job.Done && time.Since(job.FinishedAt) > hashProgressRetention {
+			delete(hashJobs.byPath, path)
+		}
+	}
+	hashJobs.byPath[filePath] = progress
+	hashJobs.Unlock()
+
+	c, err := cachedFileCID(filePath, opts, force, func(hashed int64) {
+		hashJobs.Lock()
+		progress.Hashed = hashed
+		hashJobs.Unlock()
+	})
+
+	hashJobs.Lock()
+	progress.Done = true
+	progress.FinishedAt = time.Now()
+	if err != nil {
+		progress.Error = err.Error()
+	} else {
+		progress.CID = c.String()
+	}
+	hashJobs.Unlock()
+	return c, err
+}
+
+// Progress of hashing the file at path, which is canonicalized the way advertiseFile
+// does so relative and symlinked spellings find the job
+func hashProgressFor(path string) (hashProgress, bool) {
+	if resolved, err := resolveSharePath(path); err == nil {
+		path = resolved
+	}
+	hashJobs.Lock()
+	defer hashJobs.Unlock()
+	job, ok := hashJobs.byPath[path]
+	if !ok {
+		return hashProgress{}, false
+	}
+	return *job, true
+}
+
+// Handler reporting how far hashing of ?filepath= has got
+func (h *dhtHandler) hashProgressHandler(w http.ResponseWriter, r *http.Request) {
+	// Set CORS headers
+	w.Header().Set("Access-Control-Allow-Origin", "http://localhost:5173") // Change to your frontend's URL
+	w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+
+	// Handle preflight OPTIONS request
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	progress, ok := hashProgressFor(r.URL.Query().Get("filepath"))
+	if !ok {
+		http.Error(w, "No hashing in progress for that file", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(progress)
+}
+
+// Handler to view (GET) or change (POST ?hash=&cidversion=&codec=) how this node
+// addresses the content it shares by default
+func (h *dhtHandler) cidSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	// Set CORS headers
+	w.Header().Set("Access-Control-Allow-Origin", "http://localhost:5173") // Change to your frontend's URL
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+
+	// Handle preflight OPTIONS request
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	opts := nodeCIDOptions()
+	if r.Method == http.MethodPost {
+		o, err := cidOverridesFromQuery(r.URL.Query())
+		if err == nil {
+			opts, err = saveCIDSettings(o)
+		} else {
+			err = badRequest("%v", err)
+		}
+		if err != nil {
+			writeLegacyError(w, err)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(opts)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Progress is recorded under the canonical path, so relative and symlinked spellings
+// of the same file must find it
+func TestHashProgressCanonicalPath(t *testing.T) {
+	saved := catalog
+	defer func() { catalog = saved }()
+	catalog = openTestStore(t)
+
+	base, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(base, "real")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "big.bin")
+	if err := os.WriteFile(file, []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(dir, filepath.Join(base, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := hashFileTracked(file, 7, defaultCIDOptions, true); err != nil {
+		t.Fatal(err)
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(base); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	h := &dhtHandler{}
+	for _, path := range []string{
+		file,
+		filepath.Join("real", "big.bin"),
+		filepath.Join(base, "link", "big.bin"),
+		filepath.Join("link", "big.bin"),
+	} {
+		rec := httptest.NewRecorder()
+		h.hashProgressHandler(rec, httptest.NewRequest(http.MethodGet, "/advertise/progress?filepath="+url.QueryEscape(path), nil))
+		if rec.Code != http.StatusOK {
+			t.Errorf("%q: status %d", path, rec.Code)
+			continue
+		}
+		var progress hashProgress
+		if err := json.NewDecoder(rec.Body).Decode(&progress); err != nil {
+			t.Fatal(err)
+		}
+		if progress.Path != file || !progress.Done || progress.CID == "" {
+			t.Errorf("%q: got %+v", path, progress)
+		}
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// Inode numbers aren't available here; size and mtime alone key the hash cache
+func fileInode(info os.FileInfo) uint64 {
+	return 0
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	integrityScanInterval  = 15 * time.Minute
+	integrityPolicySetting = "integrity_policy"
+
+	integrityOK      = "ok"
+	integrityChanged = "changed" // the file no longer hashes to its CID
+	integrityMissing = "missing" // the file is gone or isn't readable
+)
+
+// What the scanner last saw of a shared file
+type integrityRecord struct {
+	CID       string    `json:"cid"`
+	Path      string    `json:"path"`
+	Size      int64     `json:"size"`
+	ModTime   time.Time `json:"mod_time"`
+	Status    string    `json:"status"`
+	CheckedAt time.Time `json:"checked_at"`
+	Withdrawn bool      `json:"withdrawn,omitempty"`
+}
+
+// With Withdraw set, files that changed or vanished are taken out of the catalog.
+// Otherwise they stay listed but flagged, and we refuse to serve them.
+type integrityPolicy struct {
+	Withdraw bool `json:"withdraw"`
+}
+
+func (ms *metadataStore) Integrity(cid string) (integrityRecord, bool, error) {
+	var record integrityRecord
+	found := false
+	err := ms.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(integrityBucket).Get([]byte(cid))
+		if data == nil {
+			return nil
+		}
+		if err := json.Unmarshal(data, &record); err != nil {
+			return fmt.Errorf("failed to parse integrity record for %s: %w", cid, err)
+		}
+		found = true
+		return nil
+	})
+	return record, found, err
+}
+
+func (ms *metadataStore) PutIntegrity(record integrityRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return ms.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(integrityBucket).Put([]byte(record.CID), data)
+	})
+}
+
+func (ms *metadataStore) IntegrityRecords() ([]integrityRecord, error) {
+	records := []integrityRecord{}
+	err := ms.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(integrityBucket).ForEach(func(k, v []byte) error {
+			var record integrityRecord
+			if err := json.Unmarshal(v, &record); err != nil {
+				return fmt.Errorf("failed to parse integrity record for %s: %w", k, err)
+			}
+			records = append(records, record)
+			return nil
+		})
+	})
+	return records, err
+}
+
+// Drops records of files that are no longer listed, unless they were withdrawn by the scanner
+func (ms *metadataStore) pruneIntegrity(listed map[string]bool) error {
+	return ms.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(integrityBucket)
+		var stale [][]byte
+		bucket.ForEach(func(k, v []byte) error {
+			var record integrityRecord
+			if json.Unmarshal(v, &record) == nil && !listed[string(k)] && !record.Withdrawn {
+				stale = append(stale, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		for _, k := range stale {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Whether metadata's file can still be served as its CID. The last scan must have found
+// it intact; files not scanned yet count as intact, and so do withdrawn ones, since
+// listing them again means they were just hashed. On top of that the file's size and
+// mtime must still be the ones it had when it was last hashed, so a file edited since
+// the last scan isn't served until it has been checked again.
+func servableIntegrity(metadata FileMetadata) bool {
+	record, found, err := catalog.Integrity(metadata.CID)
+	if err != nil {
+		log.Printf("%v", err)
+		return false
+	}
+	if found && !record.Withdrawn && record.Status != integrityOK {
+		return false
+	}
+
+	info, err := os.Stat(metadata.FilePath)
+	if err != nil || !info.Mode().IsRegular() {
+		return false
+	}
+	expected, err := cid.Decode(metadata.CID)
+	if err != nil {
+		return false
+	}
+	opts, err := cidOptionsFor(expected)
+	if err != nil {
+		return false
+	}
+	if entry, cached := catalog.cachedHash(hashCacheKey(metadata.FilePath, opts)); cached {
+		c, err := cid.Decode(entry.CID)
+		return err == nil && c.Equals(expected) && entry.Size == info.Size() && entry.ModTime.Equal(info.ModTime())
+	}
+	if found && !record.Withdrawn {
+		return record.Size == info.Size() && record.ModTime.Equal(info.ModTime())
+	}
+	return true
+}
+
+// Serializes scans started by the ticker and over HTTP
+var integrityScanMu sync.Mutex
+
+// Checks one shared file against its CID. Files whose size, mtime and inode haven't
+// moved since they were last hashed are answered from the hash cache unless force is set.
+func checkFileIntegrity(metadata FileMetadata, force bool) integrityRecord {
+	record := integrityRecord{CID: metadata.CID, Path: metadata.FilePath, CheckedAt: time.Now()}
+
+	info, err := os.Stat(metadata.FilePath)
+	if err != nil || !info.Mode().IsRegular() {
+		record.Status = integrityMissing
+		return record
+	}
+	record.Size = info.Size()
+	record.ModTime = info.ModTime()
+
+	expected, err := cid.Decode(metadata.CID)
+	if err != nil {
+		record.Status = integrityChanged
+		return record
+	}
+	opts, err := cidOptionsFor(expected)
+	if err != nil {
+		record.Status = integrityChanged
+		return record
+	}
+	got, err := cachedFileCID(metadata.FilePath, opts, force, nil)
+	switch {
+	case err != nil:
+		record.Status = integrityMissing
+	case !got.Equals(expected):
+		record.Status = integrityChanged
+	default:
+		record.Status = integrityOK
+	}
+	return record
+}
+
+// scanIntegrity checks every shared file once and applies the policy to those that
+// no longer match their CID. force rehashes every file instead of trusting the hash cache.
+func scanIntegrity(force bool) ([]integrityRecord, error) {
+	integrityScanMu.Lock()
+	defer integrityScanMu.Unlock()
+
+	var policy integrityPolicy
+	if _, err := catalog.Setting(integrityPolicySetting, &policy); err != nil {
+		return nil, err
+	}
+	entries, err := catalog.List()
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]integrityRecord, 0, len(entries))
+	listed := make(map[string]bool, len(entries))
+	for _, metadata := range entries {
+		listed[metadata.CID] = true
+		previous, known, err := catalog.Integrity(metadata.CID)
+		if err != nil {
+			log.Printf("%v", err)
+		}
+		record := checkFileIntegrity(metadata, force)
+
+		if record.Status != integrityOK {
+			if !known || previous.Status != record.Status {
+				log.Printf("Shared file for CID %s is %s: %s", metadata.CID, record.Status, metadata.FilePath)
+			}
+			if policy.Withdraw {
+				if err := catalog.Remove(metadata.CID); err != nil {
+					log.Printf("%v", err)
+				} else {
+					record.Withdrawn = true
+					log.Printf("Withdrew CID %s from the catalog", metadata.CID)
+				}
+			}
+		}
+		if err := catalog.PutIntegrity(record); err != nil {
+			log.Printf("Failed to store integrity record for %s: %v", metadata.CID, err)
+		}
+		results = append(results, record)
+	}
+	if err := catalog.pruneIntegrity(listed); err != nil {
+		log.Printf("Failed to prune integrity records: %v", err)
+	}
+	return results, nil
+}
+
+// Rescans the catalog every integrityScanInterval until ctx is done
+func runIntegrityScanner(ctx context.Context) {
+	ticker := time.NewTicker(integrityScanInterval)
+	defer ticker.Stop()
+	for {
+		if _, err := scanIntegrity(false); err != nil {
+			log.Printf("Integrity scan failed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Handler for the integrity scanner: GET lists the last results (optionally ?status=),
+// POST changes the policy with ?withdraw= and, with ?scan=true, rescans right away
+// (add ?rehash=true to bypass the hash cache).
+func (h *dhtHandler) integrityHandler(w http.ResponseWriter, r *http.Request) {
+	// Set CORS headers
+	w.Header().Set("Access-Control-Allow-Origin", "http://localhost:5173") // Change to your frontend's URL
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+
+	// Handle preflight OPTIONS request
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	var policy integrityPolicy
+	if _, err := catalog.Setting(integrityPolicySetting, &policy); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		query := r.URL.Query()
+		if v := query.Get("withdraw"); v != "" {
+			withdraw, err := strconv.ParseBool(v)
+			if err != nil {
+				http.Error(w, "Invalid withdraw flag", http.StatusBadRequest)
+				return
+			}
+			policy.Withdraw = withdraw
+			if err := catalog.PutSetting(integrityPolicySetting, policy); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		if scan, _ := strconv.ParseBool(query.Get("scan")); scan {
+			rehash, _ := strconv.ParseBool(query.Get("rehash"))
+			if _, err := scanIntegrity(rehash); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+
+	records, err := catalog.IntegrityRecords()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	status := r.URL.Query().Get("status")
+	filtered := []integrityRecord{}
+	for _, record := range records {
+		if status == "" || record.Status == status {
+			filtered = append(filtered, record)
+		}
+	}
+	sort.Slice(filtered, func(i, j int) bool { return filtered[i].CID < filtered[j].CID })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Policy  integrityPolicy   `json:"policy"`
+		Results []integrityRecord `json:"results"`
+	}{policy, filtered})
+}
@@ -6,6 +6,7 @@ import (
 	"context"
 	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -13,7 +14,6 @@ import (
 	"strings"
 	"time"
 	"net/http"
-	"io/ioutil"
 	"os/user"
 	"strconv"
 	"path/filepath"
@@ -144,35 +144,34 @@ func connectToPeer(node host.Host, peerAddr string) {
 	fmt.Println("Connected to:", info.ID)
 }
 
-func connectToPeerUsingRelay(node host.Host, targetPeerID string) {
+func connectToPeerUsingRelay(node host.Host, targetPeerID string) error {
 	ctx := globalCtx
 	targetPeerID = strings.TrimSpace(targetPeerID)
 	relayAddr, err := multiaddr.NewMultiaddr(relay_node_addr)
 	if err != nil {
-		log.Printf("Failed to create relay multiaddr: %v", err)
+		return fmt.Errorf("failed to create relay multiaddr: %w", err)
 	}
 	peerMultiaddr := relayAddr.Encapsulate(multiaddr.StringCast("/p2p-circuit/p2p/" + targetPeerID))
 
 	relayedAddrInfo, err := peer.AddrInfoFromP2pAddr(peerMultiaddr)
 	if err != nil {
-		log.Println("Failed to get relayed AddrInfo: %w", err)
-		return
+		return fmt.Errorf("failed to get relayed AddrInfo: %w", err)
 	}
 	// Connect to the peer through the relay
-	err = node.Connect(ctx, *relayedAddrInfo)
+	err = node.Connect(network.WithAllowLimitedConn(ctx, "relay"), *relayedAddrInfo)
 	if err != nil {
-		log.Println("Failed to connect to peer through relay: %w", err)
-		return
+		return fmt.Errorf("failed to connect to peer through relay: %w", err)
 	}
 
 	fmt.Printf("Connected to peer via relay: %s\n", targetPeerID)
+	return nil
 }
 
 // Code TO BE TESTED
 
 func receiveDataFromPeer(node host.Host) {
-	// Set a stream handler to listen for incoming streams on the "/senddata/p2p" protocol
-	node.SetStreamHandler("/senddata/p2p", func(s network.Stream) {
+	// Set a stream handler to listen for incoming streams on every senddata protocol version
+	setVersionedStreamHandler(node, sendDataProtocols, func(s network.Stream) {
 		defer s.Close()
 
 		// Step 1: Read the data (peerID and CID) from the stream
@@ -187,10 +186,11 @@ func receiveDataFromPeer(node host.Host) {
 			return
 		}
 
-		// Step 2: Parse the received data (peerID and CID)
+		// Step 2: Parse the received data (peerID, CID and, from 1.1.0 on, the codecs the peer accepts)
+		negotiate := sendDataNegotiates(s.Protocol())
 		parts := strings.Split(string(data), ",")
-		if len(parts) != 2 {
-			log.Printf("Invalid data format received: %v", string(data))
+		if (negotiate && len(parts) != 3) || (!negotiate && len(parts) != 2) {
+			log.Printf("Invalid data format received on %s: %v", s.Protocol(), string(data))
 			return
 		}
 		peerID := strings.TrimSpace(parts[0])
@@ -199,139 +199,200 @@ func receiveDataFromPeer(node host.Host) {
 		log.Printf("Received request from Peer %s for file with CID: %s", peerID, cid)
 
 		// Step 3: Find the file associated with the CID (from metadata)
-		// For simplicity, assuming a function 'findFilePathByCID' to retrieve the file path
-		filepath := findFilePathByCID(cid)
-		if filepath == "" {
+		metadata, found := catalog.Get(canonicalCID(cid))
+		if !found {
 			log.Printf("File for CID %s not found.", cid)
 			return
 		}
+		if !servableIntegrity(metadata) {
+			// Whatever is at the path now isn't what was advertised
+			log.Printf("Refusing CID %s: shared file failed its integrity check", cid)
+			return
+		}
+		filepath := metadata.FilePath
+		if downloadCache != nil {
+			downloadCache.Touch(metadata.CID)
+		}
 
 		// Step 4: Send the file to Peer A
-		sendFileToPeer(s, filepath)
+		log.Printf("Serving CID %s to %s over a %s connection", cid, s.Conn().RemotePeer(), streamPath(s, pathDirect))
+		if !negotiate {
+			// Older peers don't negotiate and expect the raw bytes, which would give paid files away
+			if metadata.Price > 0 {
+				log.Printf("Refusing paid CID %s to %s: peer can't receive encrypted transfers", cid, s.Conn().RemotePeer())
+				return
+			}
+			if _, err := sendFileToPeer(s, filepath, ""); err == nil {
+				catalog.CountDownload(metadata.CID)
+			}
+			return
+		}
+		codec := negotiateCodec(parts[2], shouldCompressFile(filepath))
+		header := transferHeader{Codec: codec}
+		var out io.Writer = s
+		if metadata.Price > 0 {
+			// Paid files go out encrypted; the key is released once payment is confirmed
+			out, header, err = encryptForBuyer(s, metadata, s.Conn().RemotePeer(), codec)
+			if err != nil {
+				log.Printf("Failed to set up encryption for CID %s: %v", cid, err)
+				return
+			}
+		}
+		if _, err := s.Write([]byte(header.String() + "\n")); err != nil {
+			log.Printf("Failed to send transfer header: %v", err)
+			return
+		}
+		sent, err := sendFileToPeer(out, filepath, codec)
+		if err != nil {
+			return
+		}
+		catalog.CountDownload(metadata.CID)
+		// The receipt for a paid file comes with its key release, once the buyer can check it
+		if sendDataHasReceipts(s.Protocol()) && !header.Encrypted() {
+			collectReceipt(s, buf, cid, sent, "")
+		}
 	})
 }
 
-func sendFileToPeer(s network.Stream, filepath string) { // used by the other peer
+// Sends the file through the codec, returning how many bytes of it were read
+func sendFileToPeer(s io.Writer, filepath string, codec string) (int64, error) { // used by the other peer
 	// Open the file to send
 	file, err := os.Open(filepath)
 	if err != nil {
 		log.Printf("Failed to open file '%s': %v", filepath, err)
-		return
+		return 0, err
 	}
 	defer file.Close()
 
+	cw, err := newCompressWriter(codec, s)
+	if err != nil {
+		log.Printf("Failed to set up %s encoder: %v", codec, err)
+		return 0, err
+	}
+
 	// Copy the file content into the stream
-	_, err = io.Copy(s, file)
+	sent, err := io.Copy(cw, file)
 	if err != nil {
 		log.Printf("Failed to send file data: %v", err)
-		return
+		return sent, err
+	}
+	if err := cw.Close(); err != nil {
+		log.Printf("Failed to flush %s encoder: %v", codec, err)
+		return sent, err
 	}
 
-	log.Printf("File '%s' sent successfully.", filepath)
+	log.Printf("File '%s' sent successfully (codec: %s).", filepath, codec)
+	return sent, nil
 }
 
-func (h *dhtHandler) sendDataToPeer(w http.ResponseWriter, r *http.Request) { // CID is the file hash that Peer (SEEMS TO BE CORRECT) // This might need to be a handler() for http 
-	// Set CORS headers
-	w.Header().Set("Access-Control-Allow-Origin", "http://localhost:5173") // Change to your frontend's URL
-	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
-
-	// Handle preflight OPTIONS request
-	if r.Method == http.MethodOptions {
-		w.WriteHeader(http.StatusNoContent)
-		return
-	}
+// Body of POST /api/v1/transfers, and what /file-transfer-request/ reads from its query
+type transferRequest struct {
+	CID    string `json:"cid"`
+	PeerID string `json:"peer_id"`
+}
 
-	targetPeerID := r.URL.Query().Get("targetPeerID")
-	cid := r.URL.Query().Get("cid")
+// What downloadFile got. Locked is set instead when a paid file arrived encrypted.
+type transferOutcome struct {
+	CID           string          `json:"cid"`
+	PeerID        string          `json:"peer_id"`
+	Path          string          `json:"path"`
+	Size          int64           `json:"size"`
+	Protocol      string          `json:"protocol"`
+	TransportPath string          `json:"transport_path"`
+	Locked        *lockedDownload `json:"-"`
+}
 
-	var ctx = context.Background()
-	targetPeerID = strings.TrimSpace(targetPeerID)
-	relayAddr, err := multiaddr.NewMultiaddr(relay_node_addr)
+// downloadFile fetches req.CID from req.PeerID into the downloads directory, checks it
+// against the CID and starts seeding it.
+func (h *dhtHandler) downloadFile(ctx context.Context, req transferRequest) (transferOutcome, error) {
+	outcome := transferOutcome{CID: req.CID, PeerID: req.PeerID}
+	targetID, err := parsePeerID(req.PeerID)
 	if err != nil {
-		log.Printf("Failed to create relay multiaddr: %v", err)
+		return outcome, badRequest("%v", err)
 	}
-	peerMultiaddr := relayAddr.Encapsulate(multiaddr.StringCast("/p2p-circuit/p2p/" + targetPeerID))
-
-	peerinfo, err := peer.AddrInfoFromP2pAddr(peerMultiaddr)
-	if err != nil {
-		log.Fatalf("Failed to parse peer address: %s", err)
+	if _, err := cid.Decode(req.CID); err != nil {
+		return outcome, badRequest("invalid CID %q", req.CID)
 	}
-	if err := h.node.Connect(ctx, *peerinfo); err != nil {
-		log.Printf("Failed to connect to peer %s via relay: %v", peerinfo.ID, err)
-		return
-	}
-	s, err := h.node.NewStream(network.WithAllowLimitedConn(ctx, "/senddata/p2p"), peerinfo.ID, "/senddata/p2p")
+
+	downloadPath, err := getDownloadPath()
 	if err != nil {
-		log.Printf("Failed to open stream to %s: %s", peerinfo.ID, err)
-		return
+		return outcome, err
 	}
-	defer s.Close()
+	outcome.Path = downloadPath + "/" + req.CID // Save the file with the CID as the name
 
-	// Step 1: Send the peerID and CID to Peer B
-	peerID := h.node.ID().String()
-	request := fmt.Sprintf("%s,%s\n", peerID, cid)
-	_, err = s.Write([]byte(request))
+	// fetchFromPeer checks what arrived against the CID before we keep or seed it
+	result, err := h.fetchFromPeer(ctx, targetID, req.CID, outcome.Path, nil)
 	if err != nil {
-		log.Printf("Failed to send request to Peer B: %s", err)
-		return
+		log.Printf("Failed to fetch CID %s from %s: %v", req.CID, targetID, err)
+		if errors.Is(err, errCIDMismatch) {
+			return outcome, newAPIError(http.StatusBadGateway, errCodeVerificationFailed, "downloaded file does not match its CID")
+		}
+		return outcome, upstreamFailed("failed to transfer file")
+	}
+	outcome.Size = result.Written
+	outcome.Protocol = result.Protocol
+	outcome.TransportPath = result.TransportPath
+	if result.Locked != nil {
+		outcome.Locked = result.Locked
+		return outcome, nil
 	}
 
-	log.Printf("Sent request to Peer B for file with CID: %s", cid)
+	catalog.RecordDownload(downloadRecord{CID: req.CID, Path: outcome.Path, Peer: targetID.String(), Size: result.Written, CompletedAt: time.Now()})
+	h.seedDownload(req.CID, outcome.Path)
+	return outcome, nil
+}
 
-	// Step 2: Receive the file from Peer B
-	downloadPath, err := getDownloadPath()
-	outputFileName := downloadPath + "/" + cid // Save the file with the CID as the name
-	file, err := os.Create(outputFileName)
-	if err != nil {
-		log.Printf("Failed to create output file: %v", err)
+func (h *dhtHandler) sendDataToPeer(w http.ResponseWriter, r *http.Request) { // CID is the file hash that Peer (SEEMS TO BE CORRECT) // This might need to be a handler() for http 
+	// Set CORS headers
+	w.Header().Set("Access-Control-Allow-Origin", "http://localhost:5173") // Change to your frontend's URL
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+
+	// Handle preflight OPTIONS request
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
 		return
 	}
-	defer file.Close()
 
-	// Copy the received file data from the stream into the file
-	written, err := io.Copy(file, s)
+	outcome, err := h.downloadFile(context.Background(), transferRequest{
+		CID:    r.URL.Query().Get("cid"),
+		PeerID: r.URL.Query().Get("targetPeerID"),
+	})
 	if err != nil {
-		log.Printf("Failed to write file data: %v", err)
+		writeLegacyError(w, err)
+		return
+	}
+	w.Header().Set("X-Transfer-Path", outcome.TransportPath)
+	w.Header().Set("X-Protocol-Version", outcome.Protocol)
+
+	if outcome.Locked != nil {
+		// Paid file: tell the UI what to pay before it can be unlocked
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusPaymentRequired)
+		json.NewEncoder(w).Encode(outcome.Locked)
 		return
 	}
 
 	w.Write([]byte("Successfully File Sent!"))
-
-	log.Printf("File received and saved as '%s' (%d bytes)", outputFileName, written)
-
 }
 
 // RECEIVE FILE FROM PEER WHICH IS A HANDLER FOR A NEW STREAM THAT IS SPECIALIZED FOR RECEIVING A FILE FROM ANOTHER PEER USING ANOTHER PROTOCOL
 
 func findFilePathByCID(cid string) string { // logic seems to be correct
-    // Read metadata from the file
-    existingMetadata, err := readMetadataFromFile(node_id)
-    if err != nil {
-        log.Printf("Failed to read existing metadata: %v", err)
-        return ""
-    }
-
-    // Step 2: Search for the CID in the metadata list
-    for _, entry := range existingMetadata {
-        if entry.CID == cid {
-            log.Printf("Found file for CID %s: %s", cid, entry.FilePath)
-            log.Printf(entry.FilePath)
-
-            return entry.FilePath
-        }
-    }
-
-    // If no match is found
-    log.Printf("No file found for CID %s", cid)
-    return ""
+	metadata, found := catalog.Get(canonicalCID(cid))
+	if !found {
+		log.Printf("No file found for CID %s", cid)
+		return ""
+	}
+	log.Printf("Found file for CID %s: %s", cid, metadata.FilePath)
+	return metadata.FilePath
 }
 
 // Code TO BE TESTED
 
-func handlePeerExchange(node host.Host) {
+func handlePeerExchange(node host.Host, kadDHT *dht.IpfsDHT) {
 	relayInfo, _ := peer.AddrInfoFromString(relay_node_addr)
-	node.SetStreamHandler("/orcanet/p2p", func(s network.Stream) {
+	setVersionedStreamHandler(node, peerExchangeProtocols, func(s network.Stream) {
 		defer s.Close()
 
 		buf := bufio.NewReader(s)
@@ -353,7 +414,19 @@ func handlePeerExchange(node host.Host) {
 				if peerMap, ok := peer.(map[string]interface{}); ok {
 					if peerID, ok := peerMap["peer_id"].(string); ok {
 						if string(peerID) != string(relayInfo.ID) {
-							connectToPeerUsingRelay(node, peerID)
+							go func(peerID string) {
+								id, err := parsePeerID(peerID)
+								if err != nil {
+									log.Printf("Skipping exchanged peer: %v", err)
+									return
+								}
+								connectPath, err := connectToPeerPreferDirect(globalCtx, node, kadDHT, id)
+								if err != nil {
+									log.Printf("Failed to connect to exchanged peer %s: %v", id, err)
+									return
+								}
+								log.Printf("Connected to exchanged peer %s via %s", id, connectPath)
+							}(peerID)
 						}
 					}
 				}
@@ -368,38 +441,6 @@ type dhtHandler struct {
 	node host.Host
 }
 
-func readMetadataFromFile(node_id string) ([]FileMetadata, error) {
-	// Open the JSON file
-
-	downloadPath, err := getDownloadPath()
-	jsonPath := downloadPath + "/" + node_id
-
-	file, err := os.Open(jsonPath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			// If the file does not exist, return an empty slice (no metadata yet)
-			return []FileMetadata{}, nil
-		}
-		return nil, fmt.Errorf("failed to open file: %w", err)
-	}
-	defer file.Close()
-
-	// Read the file contents
-	data, err := ioutil.ReadAll(file)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read file: %w", err)
-	}
-
-	// Parse the JSON data into a slice of FileMetadata
-	var metadata []FileMetadata
-	err = json.Unmarshal(data, &metadata)
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse JSON: %w", err)
-	}
-
-	return metadata, nil
-}
-
 // String method for FileMetadata to customize its string representation
 func (f FileMetadata) String() string {
 	return fmt.Sprintf("cid: %s, description: %s, price: %f\n", f.CID, f.FileDescription, f.Price)
@@ -414,58 +455,6 @@ func String(fms []FileMetadata) string {
 	return result
 }
 
-// 	CHECK IF THERE IS ANOTHER EXTRY FOR THE SAME CID IF YES THEN THINK ABOUT WHAT TO DO!
-func writeMetadataToFile(username string, newMetadata FileMetadata) error { //username = node_id
-    // Read existing metadata from the file
-    downloadPath, err := getDownloadPath()
-    jsonPath := downloadPath + "/" + username
-
-    existingMetadata, err := readMetadataFromFile(username)
-    if err != nil {
-        return fmt.Errorf("failed to read existing metadata: %w", err)
-    }
-
-	// Debugging: Check the content of existingMetadata before marshaling
-	fmt.Printf("Existing Metadata: %+v\n", existingMetadata)
-
-	// Check for duplicate CIDs in the existing metadata
-    duplicateFound := false
-    for _, metadata := range existingMetadata {
-        if metadata.CID == newMetadata.CID {
-            duplicateFound = true
-
-            break
-        }
-    }
-
-    // If a duplicate is found, do not append the new metadata
-    if duplicateFound {
-        log.Println("Duplicate CID found. Skipping the addition of new metadata.")
-        return nil
-    }
-
-    // Append the new metadata entry
-	existingMetadata = append(existingMetadata, newMetadata)
-
-	// Convert the entire updated metadata slice back to JSON
-	data, err := json.MarshalIndent(existingMetadata, "", " ")
-	if err != nil {
-	return fmt.Errorf("failed to encode JSON: %w", err)
-	}
-
-	// Debugging: Print the marshaled JSON before writing
-	fmt.Println("Marshaled JSON:", string(data))
-
-	// Write the updated JSON data back to the file
-	err = ioutil.WriteFile(jsonPath, data, 0644)
-	if err != nil {
-	return fmt.Errorf("failed to write to file: %w", err)
-	}
-	log.Println("New metadata added successfully!")
-	return nil
-
-}
-
 // Function to get the download path for the current user
 func getDownloadPath() (string, error) {
 	// Get the current user
@@ -505,16 +494,100 @@ func createCIDFromFile(content []byte) cid.Cid {
 
 // Function to open a file and hash it using SHA-256
 func hashFileSHA256(filePath string) (cid.Cid, error) {
-	// Open the file
-	content, err := ioutil.ReadFile(filePath)
+	return hashFileWithProgress(filePath, defaultCIDOptions, nil)
+}
+
+// Hashes the file in fixed-size chunks so memory stays bounded however large it is,
+// addressing it as opts says. onProgress, if set, is called with the number of bytes
+// hashed so far.
+func hashFileWithProgress(filePath string, opts cidOptions, onProgress func(int64)) (cid.Cid, error) {
+	if err := opts.validate(); err != nil {
+		return cid.Undef, err
+	}
+	file, err := os.Open(filePath)
 	if err != nil {
-		log.Fatalf("Failed to read file: %v", err)
+		return cid.Undef, fmt.Errorf("failed to open file: %w", err)
 	}
+	defer file.Close()
 
-	cid := createCIDFromFile(content)
-	fmt.Printf("Generated CID: %s\n", cid.String())
+	c, err := hashReader(file, opts, onProgress)
+	if err != nil {
+		return cid.Undef, err
+	}
+	log.Printf("Generated CID %s for %s", c, filePath)
+
+	return c, nil
+}
+
+// Addresses everything r yields as opts says, like hashFileWithProgress does for a file
+func hashReader(r io.Reader, opts cidOptions, onProgress func(int64)) (cid.Cid, error) {
+	if err := opts.validate(); err != nil {
+		return cid.Undef, err
+	}
+	if opts.Codec == "dag-pb" {
+		if onProgress != nil {
+			r = io.TeeReader(r, &progressWriter{w: io.Discard, onProgress: onProgress})
+		}
+		return unixfsCID(r, opts)
+	}
 
-	return cid, err
+	code := supportedHashes[opts.Hash]
+	hasher, err := multihash.GetHasher(code)
+	if err != nil {
+		return cid.Undef, err
+	}
+	var dst io.Writer = hasher
+	if onProgress != nil {
+		dst = &progressWriter{w: hasher, onProgress: onProgress}
+	}
+	if _, err := io.CopyBuffer(dst, r, make([]byte, hashChunkSize)); err != nil {
+		return cid.Undef, fmt.Errorf("failed to read file: %w", err)
+	}
+
+	mh, err := multihash.Encode(hasher.Sum(nil), code)
+	if err != nil {
+		return cid.Undef, fmt.Errorf("error encoding multihash: %w", err)
+	}
+	return opts.cidFor(mh), nil
+}
+
+// Body of POST /api/v1/catalog, and what /advertise/ reads from its query
+type advertiseRequest struct {
+	FilePath      string   `json:"filepath"`
+	Price         *float64 `json:"price"`
+	Description   string   `json:"fileDescription"`
+	WalletAddress string   `json:"walletaddress"`
+	Tags          []string `json:"tags,omitempty"`
+	Rehash        bool     `json:"rehash,omitempty"` // ignore the hash cache
+	cidOverrides
+}
+
+// advertise lists the file at req.FilePath through advertiseFile, reporting whether its
+// CID was already listed, in which case the existing entry comes back unchanged
+func (h *dhtHandler) advertise(ctx context.Context, req advertiseRequest) (FileMetadata, bool, error) {
+	opts, err := req.cidOverrides.resolve()
+	if err != nil {
+		return FileMetadata{}, false, badRequest("%v", err)
+	}
+	if req.Price == nil || *req.Price < 0 {
+		return FileMetadata{}, false, badRequest("a price of at least 0 is required")
+	}
+	c, exists, err := h.advertiseFile(ctx, FileMetadata{
+		FileDescription: req.Description,
+		Price:           *req.Price,
+		FilePath:        req.FilePath,
+		WalletAddress:   req.WalletAddress,
+		Tags:            req.Tags,
+	}, opts, req.Rehash)
+	if err != nil {
+		return FileMetadata{}, false, err
+	}
+	if !exists {
+		log.Printf("Successfully advertised as provider for CID: %s\n", c)
+	}
+
+	metadata, _ := catalog.Get(c.String())
+	return metadata, exists, nil
 }
 
 // Handler to advertise provider and store metadata in local JSON
@@ -530,55 +603,32 @@ func (h *dhtHandler) advertiseHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	w.Write([]byte("Hello World!2.0"))
-
-	filepath := r.URL.Query().Get("filepath")
-	price := r.URL.Query().Get("price")
-	file_description := r.URL.Query().Get("description")
-	walletaddress := r.URL.Query().Get("walletaddress") 
-
-    // Parse CID from string //POTENTIALLY CID DEBUG NEEDED
-    c, err := hashFileSHA256(filepath)
-    if err != nil {
-        http.Error(w, "Invalid CID", http.StatusBadRequest)
-        return
-    }
-
-    // Simulate storing provider in DHT using putProvider()
-    err = h.kadDHT.Provide(context.Background(), c, true)
-    if err != nil {
-        fmt.Fprintf(w, "err: , %s", err)
-        return
-    }
-
-    // Simulate storing metadata locally in JSON (you can enhance this part)
-
-    cidStr, err := hashFileSHA256(filepath) //get the file using the IO Functions and use SHA-256 to get the filehash; CURRENTY THIS IMPLEMENTATION IS WRONG!!!
-
-    // ADD ERROR HANDLING HERE BY CHECKING THE 'err' VARIABLE
-
-    // Convert the string price to an integer
-    price_int, err := strconv.ParseFloat(price, 64)
-    if err != nil {
-        http.Error(w, "Invalid ID", http.StatusBadRequest)
-        return
-    }
-
-    metadata := FileMetadata{
-        CID: cidStr.String(),
-        FileDescription: file_description,
-        Price: price_int,
-        FilePath: filepath,
-        WalletAddress: walletaddress,
-    }
-    
-    err = writeMetadataToFile(node_id, metadata)
-    if err != nil {
-        log.Printf("%s\n", err)
-    }
+	query := r.URL.Query()
+	req := advertiseRequest{
+		FilePath:      query.Get("filepath"),
+		Description:   query.Get("description"),
+		WalletAddress: query.Get("walletaddress"),
+		Tags:          parseTags(query.Get("tags")),
+	}
+	req.Rehash, _ = strconv.ParseBool(query.Get("rehash"))
+	if price, err := strconv.ParseFloat(query.Get("price"), 64); err == nil {
+		req.Price = &price
+	}
+	overrides, err := cidOverridesFromQuery(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.cidOverrides = overrides
 
-    log.Printf("Successfully advertised as provider for CID: %s\n", cidStr.String())
+	metadata, _, err := h.advertise(context.Background(), req)
+	if err != nil {
+		writeLegacyError(w, err)
+		return
+	}
 
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(metadata)
 }
 
 // Pushkar's Code
@@ -589,14 +639,27 @@ type FileMetadata struct {
     Price float64 `json:"price"`
     FilePath string `json:"filepath"`
     WalletAddress string `json:"walletaddress"`
+    // Filled in from the file when it is advertised (schema version 1)
+    FileName string `json:"fileName,omitempty"`
+    Size int64 `json:"size,omitempty"`
+    MimeType string `json:"mimeType,omitempty"`
+    CreatedAt time.Time `json:"createdAt"`
+    UpdatedAt time.Time `json:"updatedAt"`
+    Tags []string `json:"tags,omitempty"`
+    DownloadCount int64 `json:"downloadCount"`
 }
 
 
 func setupCIDQueryHandler(node host.Host) {
 	// Handle incoming streams for CID queries
-	node.SetStreamHandler("/cid-get/1.0.0", func(s network.Stream) {
+	setVersionedStreamHandler(node, cidGetProtocols, func(s network.Stream) {
 		defer s.Close()
 
+		if s.Protocol() == cidGetV1_2 {
+			serveCIDBatch(node, s)
+			return
+		}
+
 		// Read the requested CID from the stream
 		buf := bufio.NewReader(s)
 		requestedCID, err := buf.ReadString('\n')
@@ -604,21 +667,19 @@ func setupCIDQueryHandler(node host.Host) {
 			log.Printf("Error reading CID from stream: %v", err)
 			return
 		}
+		// From 1.1.0 on, peers append the codecs they accept after a comma; 1.0.0 requests are just the CID
+		negotiate := s.Protocol() == cidGetV1_1
 		requestedCID = strings.TrimSpace(requestedCID)
-		log.Printf("Received CID query: %s", requestedCID)
-
-		// Check local metadata file for the CID
-		localMetadata, err := readMetadataFromFile(node_id)
-		if err != nil {
-			log.Printf("Error reading local metadata: %v", err)
-			return
+		var offeredCodecs string
+		if negotiate {
+			requestedCID, offeredCodecs, _ = strings.Cut(requestedCID, ",")
 		}
+		log.Printf("Received CID query: %s", requestedCID)
 
+		// Check the local catalog for the CID
 		var matchingMetadata []FileMetadata
-		for _, metadata := range localMetadata {
-			if metadata.CID == requestedCID {
-				matchingMetadata = append(matchingMetadata, metadata)
-			}
+		if metadata, found := catalog.Get(canonicalCID(requestedCID)); found {
+			matchingMetadata = append(matchingMetadata, metadata)
 		}
 
 		// Create response structure with peerID and node information
@@ -639,7 +700,12 @@ func setupCIDQueryHandler(node host.Host) {
 			return
 		}
 
-		_, err = s.Write(responseBytes)
+		if negotiate {
+			codec := negotiateCodec(offeredCodecs, len(responseBytes) >= minCompressibleSize)
+			err = writeEncoded(s, codec, responseBytes)
+		} else {
+			_, err = s.Write(responseBytes)
+		}
 		if err != nil {
 			log.Printf("Error writing response to stream: %v", err)
 			return
@@ -650,67 +716,43 @@ func setupCIDQueryHandler(node host.Host) {
 }
 
 
-func queryCIDFromPeers(node host.Host, peers []peer.ID, targetCID string) ([]struct {
-	PeerID   string         `json:"peer_id"`
+type PeerIDs struct {
+    PeerID   string         `json:"peer_id"`
 	NodeInfo string         `json:"node_info"`
 	Metadata []FileMetadata `json:"metadata"`
-}, error) {
-	var aggregatedResults []struct {
-		PeerID   string         `json:"peer_id"`
-		NodeInfo string         `json:"node_info"`
-		Metadata []FileMetadata `json:"metadata"`
-	}
-
-	for _, peerID := range peers {
-		log.Printf("Querying peer: %s for CID: %s", peerID.String(), targetCID)
-
-		// Open a stream to the peer
-		s, err := node.NewStream(context.Background(), peerID, "/cid-get/1.0.0")
-		if err != nil {
-			log.Printf("Failed to open stream to peer %s: %v", peerID, err)
-			continue
-		}
+}
 
-		// Send the CID query
-		_, err = s.Write([]byte(targetCID + "\n"))
-		if err != nil {
-			log.Printf("Error sending CID query to peer %s: %v", peerID, err)
-			s.Close()
-			continue
-		}
+// findProviders looks up who provides cidStr in the DHT and asks each of them for
+// their listing of it, giving up on whatever is still outstanding when ctx ends. The
+// answers are then filtered and ranked as pq says.
+func (h *dhtHandler) findProviders(ctx context.Context, cidStr string, pq providerQuery) ([]providerResult, error) {
+	c, err := cid.Decode(cidStr)
+	if err != nil {
+		return nil, badRequest("invalid CID %q", cidStr)
+	}
 
-		// Read the response
-		responseData, err := io.ReadAll(s)
-		if err != nil {
-			log.Printf("Error reading response from peer %s: %v", peerID, err)
-			s.Close()
-			continue
-		}
-		s.Close()
+	// Find providers for the CID
+	ctx, cancel := context.WithTimeout(ctx, 100*time.Second)
+	defer cancel()
+	providers, err := h.kadDHT.FindProviders(ctx, c)
+	if err != nil {
+		return nil, upstreamFailed("error finding providers: %v", err)
+	}
 
-		// Decode the response into a structured format
-		var peerResponse struct {
-			PeerID   string         `json:"peer_id"`
-			NodeInfo string         `json:"node_info"`
-			Metadata []FileMetadata `json:"metadata"`
-		}
-		err = json.Unmarshal(responseData, &peerResponse)
-		if err != nil {
-			log.Printf("Error decoding response from peer %s: %v", peerID, err)
-			continue
+	peerIDs := []peer.ID{}
+	for _, p := range providers {
+		if p.ID != "" { // Check if the provider has a valid ID
+			log.Printf("Found provider: %s", p.ID)
+			peerIDs = append(peerIDs, p.ID)
+		} else {
+			log.Println("Provider record with empty peer ID")
 		}
-
-		// Append to the aggregated results
-		aggregatedResults = append(aggregatedResults, peerResponse)
 	}
+	log.Printf("Found %d peers providing the CID: %s", len(peerIDs), c)
 
-	return aggregatedResults, nil
-}
-
-type PeerIDs struct {
-    PeerID   string         `json:"peer_id"`
-	NodeInfo string         `json:"node_info"`
-	Metadata []FileMetadata `json:"metadata"`
+	// Query metadata from each peer
+	results := queryCIDFromPeers(ctx, h.node, peerIDs, c.String())
+	return pq.apply(results), nil
 }
 
 // WRITE THE JSON LIST THROUGH THE RESPONSEWRITER!
@@ -727,54 +769,15 @@ func (h *dhtHandler) getProvidersHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	targetCID := r.URL.Query().Get("targetCID")
-
-	c, err := cid.Decode(targetCID)
-	if err != nil {
-		http.Error(w, "Invalid CID", http.StatusBadRequest)
-        return
-	}
-
-	// Find providers for the CID
-	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Second)
-	defer cancel()
-
-
-
-	providers, err := h.kadDHT.FindProviders(ctx, c)
-	if err != nil {
-	    log.Printf("Error finding providers: %v", err)
-	    http.Error(w, "Error finding providers", http.StatusInternalServerError)
-	    return
-	}
-
-	// Initialize an empty slice of peer.ID
-	peerIDs := []peer.ID{}
-
-	// Iterate over the slice of providers
-	for _, p := range providers {
-	    if p.ID != "" { // Check if the provider has a valid ID
-	        log.Printf("Found provider: %s", p.ID)
-	        peerIDs = append(peerIDs, p.ID)
-	    } else {
-	        log.Println("Provider record with empty peer ID")
-	    }
+	// ?maxprice=, ?sort=price|latency|reputation, ?limit= and ?offline=false narrow and rank the answers
+	var peerIDMeta []providerResult
+	pq, err := providerQueryFromValues(r.URL.Query())
+	if err == nil {
+		peerIDMeta, err = h.findProviders(r.Context(), r.URL.Query().Get("targetCID"), pq)
 	}
-
-	log.Printf("All providers: %+v", providers)
-
-	cidStr := c.String()
-
-	log.Printf("Found %d peers providing the CID: %s", len(peerIDs), c)
-
-
-
-	// Query metadata from each peer
-	peerIDMeta, err := queryCIDFromPeers(h.node, peerIDs, cidStr)
 	if err != nil {
-	    http.Error(w, "Failed to query peers", http.StatusInternalServerError)
-	    log.Printf("Error querying peers: %v", err)
-	    return
+		writeLegacyError(w, err)
+		return
 	}
 
 	// Set the Content-Type header to application/json
@@ -783,12 +786,18 @@ func (h *dhtHandler) getProvidersHandler(w http.ResponseWriter, r *http.Request)
 	// Write the JSON response
 	err = json.NewEncoder(w).Encode(peerIDMeta)
 	if err != nil {
-		http.Error(w, "Failed to encode JSON", http.StatusInternalServerError)
 		log.Printf("Error encoding JSON: %v", err)
 	}
 }
 
 func main() {
+	// Subcommands talk to an already running node instead of starting one
+	if len(os.Args) > 1 && os.Args[1] == "catalog" {
+		if err := runCatalogCommand(os.Args[2:]); err != nil {
+			log.Fatalf("%v", err)
+		}
+		return
+	}
 
 	node, dht, err := createNode()
 	if err != nil {
@@ -799,6 +808,18 @@ func main() {
 	defer cancel()
 	globalCtx = ctx
 
+	catalog, err = openMetadataStore()
+	if err != nil {
+		log.Fatalf("Failed to open metadata store: %v", err)
+	}
+	defer catalog.Close()
+	// Set before any goroutine or stream handler that reads it starts
+	downloadCache, err = openContentCache()
+	if err != nil {
+		log.Printf("Download cache disabled: %v", err)
+	}
+	go runIntegrityScanner(ctx)
+
 	fmt.Println("Node multiaddresses:", node.Addrs())
 	fmt.Println("Node Peer ID:", node.ID())
 
@@ -806,15 +827,17 @@ func main() {
 	makeReservation(node)                // make reservation on realy node
 	go refreshReservation(node, 10*time.Minute)
 	connectToPeer(node, bootstrap_node_addr) // connect to bootstrap node
-	go handlePeerExchange(node)
+	go handlePeerExchange(node, dht)
 	setupCIDQueryHandler(node)
 	receiveDataFromPeer(node)
+	setupKeyReleaseHandler(node, newBitcoinRPCVerifierFromEnv())
 
 	// sendDataToPeer(node, "12D3KooWKNWVMpDh5ZWpFf6757SngZfyobsTXA8WzAWqmAjgcdE6") // why does this exist
 
 	defer node.Close()
 
 	handler := &dhtHandler{kadDHT: dht, node: node}
+	go handler.runFolderWatcher(ctx)
 
     // Create a new router
     r := mux.NewRouter()
@@ -837,11 +860,50 @@ func main() {
     // Route to advertise a provider for a specific CID (PUT /advertise/{cid})
 	r.HandleFunc("/advertise/", handler.advertiseHandler).Methods("POST")
 
+	// Route to follow hashing of a large file while /advertise/ runs (GET /advertise/progress?filepath=)
+	r.HandleFunc("/advertise/progress", handler.hashProgressHandler).Methods("GET", "OPTIONS")
+	// Route to advertise a file uploaded in the request body
+	r.HandleFunc("/advertise/upload", handler.uploadAdvertiseHandler).Methods("POST", "OPTIONS")
+
 	// Route to get providers for a specific CID (GET /providers/{cid})
 	r.HandleFunc("/providers/", handler.getProvidersHandler).Methods("GET")
 
 	r.HandleFunc("/file-transfer-request/", handler.sendDataToPeer).Methods("POST")
 
+	r.HandleFunc("/unlock-transfer/", handler.unlockTransferHandler).Methods("POST")
+
+	r.HandleFunc("/advertise-folder/", handler.advertiseFolderHandler).Methods("POST")
+
+	r.HandleFunc("/bundle-download/", handler.downloadBundleHandler).Methods("POST")
+
+	// Route to stream content for previews, with Range support (GET /content/{cid})
+	r.HandleFunc("/content/{cid}", handler.contentGatewayHandler).Methods("GET", "HEAD", "OPTIONS")
+
+	r.HandleFunc("/seeding/", handler.seedingHandler).Methods("GET", "POST")
+
+	r.HandleFunc("/diagnostics/protocols", handler.protocolDiagnosticsHandler).Methods("GET")
+
+	r.HandleFunc("/receipts/", handler.listReceiptsHandler).Methods("GET")
+
+	// Routes to manage the files we share (GET/PUT/DELETE /catalog/{cid})
+	r.HandleFunc("/catalog/", handler.listCatalogHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/catalog/export", handler.exportCatalogHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/catalog/import", handler.importCatalogHandler).Methods("POST", "OPTIONS")
+	r.HandleFunc("/catalog/{cid}", handler.catalogEntryHandler).Methods("GET", "PUT", "DELETE", "OPTIONS")
+
+	r.HandleFunc("/downloads/", handler.listDownloadsHandler).Methods("GET")
+
+	r.HandleFunc("/settings/cid", handler.cidSettingsHandler).Methods("GET", "POST")
+
+	r.HandleFunc("/integrity/", handler.integrityHandler).Methods("GET", "POST")
+
+	r.HandleFunc("/watched-folders/", handler.watchedFoldersHandler).Methods("GET", "POST", "DELETE", "OPTIONS")
+
+	r.HandleFunc("/receipts/verify", handler.verifyReceiptHandler).Methods("POST")
+
+	// Versioned JSON API; the routes above remain as shims during the migration
+	handler.registerAPIv1(r)
+
 	// r.HandleFunc("/api/proxy", handlePostRequest).Methods("POST")
 
 
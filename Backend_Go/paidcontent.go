@@ -0,0 +1,600 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	transferKeyTTL          = 24 * time.Hour // how long a seller keeps an unpaid transfer key
+	minPaymentConfirmations = 1
+)
+
+// Key material for one encrypted transfer. Every transfer gets a fresh key, so a
+// key released to one buyer is useless for anyone else's copy.
+type transferKey struct {
+	Key           []byte    `json:"key"`
+	IV            []byte    `json:"iv"`
+	CID           string    `json:"cid"`
+	Buyer         peer.ID   `json:"buyer"`
+	Price         float64   `json:"price"`
+	WalletAddress string    `json:"wallet_address"`
+	Size          int64     `json:"size"` // of the plain file, for the buyer's receipt
+	Created       time.Time `json:"created"`
+}
+
+func newTransferKey() (*transferKey, error) {
+	tk := &transferKey{Key: make([]byte, 32), IV: make([]byte, aes.BlockSize), Created: time.Now()}
+	if _, err := rand.Read(tk.Key); err != nil {
+		return nil, fmt.Errorf("failed to generate transfer key: %w", err)
+	}
+	if _, err := rand.Read(tk.IV); err != nil {
+		return nil, fmt.Errorf("failed to generate transfer IV: %w", err)
+	}
+	return tk, nil
+}
+
+func (tk *transferKey) stream() (cipher.Stream, error) {
+	block, err := aes.NewCipher(tk.Key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewCTR(block, tk.IV), nil
+}
+
+// Stores a fresh transfer key under a new random ID, dropping keys that went unpaid
+// past transferKeyTTL. Keys are kept in the database so a restart doesn't lose ones
+// buyers are still paying for.
+func (ms *metadataStore) AddTransferKey(tk *transferKey) (string, error) {
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		return "", fmt.Errorf("failed to generate transfer ID: %w", err)
+	}
+	id := hex.EncodeToString(idBytes)
+	data, err := json.Marshal(tk)
+	if err != nil {
+		return "", err
+	}
+
+	err = ms.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(transferKeysBucket)
+		var expired [][]byte
+		bucket.ForEach(func(k, v []byte) error {
+			var old transferKey
+			if json.Unmarshal(v, &old) != nil || time.Since(old.Created) > transferKeyTTL {
+				expired = append(expired, k)
+			}
+			return nil
+		})
+		for _, k := range expired {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		return bucket.Put([]byte(id), data)
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to store transfer key: %w", err)
+	}
+	return id, nil
+}
+
+func (ms *metadataStore) TransferKey(id string) (*transferKey, bool) {
+	var tk *transferKey
+	ms.db.View(func(tx *bolt.Tx) error {
+		if data := tx.Bucket(transferKeysBucket).Get([]byte(id)); data != nil {
+			var stored transferKey
+			if json.Unmarshal(data, &stored) == nil && time.Since(stored.Created) <= transferKeyTTL {
+				tk = &stored
+			}
+		}
+		return nil
+	})
+	return tk, tk != nil
+}
+
+// Marks txid as spent on transfer id. Fails if txid already paid for another transfer;
+// the key itself stays until it expires so the buyer can ask for it again. Spent
+// payments are never forgotten, so a restart doesn't let one be replayed.
+func (ms *metadataStore) SpendPayment(id, txid string) error {
+	return ms.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(spentPaymentsBucket)
+		if paidFor := bucket.Get([]byte(txid)); paidFor != nil && string(paidFor) != id {
+			return fmt.Errorf("transaction %s already paid for another transfer", txid)
+		}
+		return bucket.Put([]byte(txid), []byte(id))
+	})
+}
+
+// encryptForBuyer wraps the stream so the paid file goes out encrypted under a fresh
+// key, and returns the header announcing it to the buyer.
+func encryptForBuyer(w io.Writer, metadata FileMetadata, buyer peer.ID, codec string) (io.Writer, transferHeader, error) {
+	tk, err := newTransferKey()
+	if err != nil {
+		return nil, transferHeader{}, err
+	}
+	tk.CID = metadata.CID
+	tk.Buyer = buyer
+	tk.Price = metadata.Price
+	tk.WalletAddress = metadata.WalletAddress
+	// The catalog's size may be unset for older entries; the receipt has to cover what is sent
+	info, err := os.Stat(metadata.FilePath)
+	if err != nil {
+		return nil, transferHeader{}, fmt.Errorf("failed to read %s: %w", metadata.FilePath, err)
+	}
+	tk.Size = info.Size()
+
+	stream, err := tk.stream()
+	if err != nil {
+		return nil, transferHeader{}, err
+	}
+	id, err := catalog.AddTransferKey(tk)
+	if err != nil {
+		return nil, transferHeader{}, err
+	}
+
+	header := transferHeader{
+		Codec:         codec,
+		TransferID:    id,
+		Price:         metadata.Price,
+		WalletAddress: metadata.WalletAddress,
+	}
+	return cipher.StreamWriter{S: stream, W: w}, header, nil
+}
+
+type keyReleaseRequest struct {
+	TransferID string `json:"transfer_id"`
+	TxID       string `json:"txid"`
+}
+
+type keyReleaseResponse struct {
+	Key   string `json:"key,omitempty"`
+	IV    string `json:"iv,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// setupKeyReleaseHandler hands out transfer keys once the buyer's payment to the
+// listing's wallet address, carrying the transfer ID as its memo, has been confirmed.
+// From 1.1.0 on the buyer answers with a receipt once it has unlocked and checked the file.
+func setupKeyReleaseHandler(node host.Host, verifier paymentVerifier) {
+	setVersionedStreamHandler(node, keyReleaseProtocols, func(s network.Stream) {
+		defer s.Close()
+
+		reply := func(resp keyReleaseResponse) {
+			data, _ := json.Marshal(resp)
+			if _, err := s.Write(append(data, '\n')); err != nil {
+				log.Printf("Error writing key release response: %v", err)
+			}
+		}
+
+		reader := bufio.NewReader(s)
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			log.Printf("Error reading key release request: %v", err)
+			return
+		}
+		var req keyReleaseRequest
+		if err := json.Unmarshal(line, &req); err != nil {
+			reply(keyReleaseResponse{Error: "malformed request"})
+			return
+		}
+
+		tk, ok := catalog.TransferKey(req.TransferID)
+		if !ok {
+			reply(keyReleaseResponse{Error: "unknown or expired transfer"})
+			return
+		}
+		if tk.Buyer != s.Conn().RemotePeer() {
+			log.Printf("Peer %s asked for the key of a transfer sent to %s", s.Conn().RemotePeer(), tk.Buyer)
+			reply(keyReleaseResponse{Error: "transfer belongs to another peer"})
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := verifier.VerifyPayment(ctx, req.TxID, tk.WalletAddress, tk.Price, req.TransferID); err != nil {
+			log.Printf("Payment %s for transfer %s not accepted: %v", req.TxID, req.TransferID, err)
+			reply(keyReleaseResponse{Error: fmt.Sprintf("payment not confirmed: %v", err)})
+			return
+		}
+		if err := catalog.SpendPayment(req.TransferID, req.TxID); err != nil {
+			reply(keyReleaseResponse{Error: err.Error()})
+			return
+		}
+
+		reply(keyReleaseResponse{Key: hex.EncodeToString(tk.Key), IV: hex.EncodeToString(tk.IV)})
+		log.Printf("Released key for CID %s to %s after payment %s", tk.CID, tk.Buyer, req.TxID)
+		if keyReleaseHasReceipts(s.Protocol()) {
+			collectReceipt(s, reader, tk.CID, tk.Size, req.TransferID)
+		}
+	})
+}
+
+// A download that arrived encrypted and is waiting for its key. The transfer ID goes
+// in the payment's memo.
+type lockedDownload struct {
+	TransferID    string        `json:"transfer_id"`
+	CID           string        `json:"cid"`
+	Seller        string        `json:"seller"`
+	Codec         string        `json:"codec"`
+	Price         float64       `json:"price"`
+	WalletAddress string        `json:"wallet_address"`
+	LockedPath    string        `json:"locked_path"`
+	OutputPath    string        `json:"output_path"`
+	Elapsed       time.Duration `json:"elapsed"` // how long the encrypted transfer took
+}
+
+// Keeps a locked download in the database, so a restart doesn't orphan its .locked file
+func (ms *metadataStore) AddLockedDownload(ld *lockedDownload) error {
+	data, err := json.Marshal(ld)
+	if err != nil {
+		return err
+	}
+	return ms.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(lockedDownloadsBucket).Put([]byte(ld.TransferID), data)
+	})
+}
+
+func (ms *metadataStore) LockedDownload(transferID string) (*lockedDownload, bool) {
+	var ld *lockedDownload
+	ms.db.View(func(tx *bolt.Tx) error {
+		if data := tx.Bucket(lockedDownloadsBucket).Get([]byte(transferID)); data != nil {
+			var stored lockedDownload
+			if json.Unmarshal(data, &stored) == nil {
+				ld = &stored
+			}
+		}
+		return nil
+	})
+	return ld, ld != nil
+}
+
+func (ms *metadataStore) RemoveLockedDownload(transferID string) error {
+	return ms.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(lockedDownloadsBucket).Delete([]byte(transferID))
+	})
+}
+
+// The seller turned the key request down, as opposed to us not reaching it
+var errKeyRefused = errors.New("seller refused to release key")
+
+// Asks the seller for a transfer's key, proving payment with txid. The stream is
+// returned open so the buyer can answer with a receipt once the file checks out; the
+// caller closes it.
+func requestTransferKey(ctx context.Context, node host.Host, seller peer.ID, transferID, txid string) ([]byte, []byte, network.Stream, error) {
+	stream, err := node.NewStream(network.WithAllowLimitedConn(ctx, "key-release"), seller, keyReleaseProtocols...)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to open key release stream: %w", err)
+	}
+	released := false
+	defer func() {
+		if !released {
+			stream.Close()
+		}
+	}()
+	recordNegotiated(seller, "key-release", stream.Protocol())
+
+	data, err := json.Marshal(keyReleaseRequest{TransferID: transferID, TxID: txid})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if _, err := stream.Write(append(data, '\n')); err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to send key release request: %w", err)
+	}
+
+	line, err := bufio.NewReader(stream).ReadBytes('\n')
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to read key release response: %w", err)
+	}
+	var resp keyReleaseResponse
+	if err := json.Unmarshal(line, &resp); err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to decode key release response: %w", err)
+	}
+	if resp.Error != "" {
+		return nil, nil, nil, fmt.Errorf("%w: %s", errKeyRefused, resp.Error)
+	}
+	key, err := hex.DecodeString(resp.Key)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid key from seller: %w", err)
+	}
+	iv, err := hex.DecodeString(resp.IV)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid IV from seller: %w", err)
+	}
+	if len(key) != 32 || len(iv) != aes.BlockSize {
+		return nil, nil, nil, fmt.Errorf("seller sent a %d-byte key and %d-byte IV", len(key), len(iv))
+	}
+	released = true
+	return key, iv, stream, nil
+}
+
+// Decrypts and decompresses a locked download into its output path, then checks
+// the result hashes to the CID that was requested. Returns the size of the file.
+func unlockDownload(ld *lockedDownload, key, iv []byte) (int64, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return 0, fmt.Errorf("invalid transfer key: %w", err)
+	}
+	if len(iv) != aes.BlockSize {
+		return 0, fmt.Errorf("invalid transfer IV length %d", len(iv))
+	}
+
+	in, err := os.Open(ld.LockedPath)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open locked download: %w", err)
+	}
+	defer in.Close()
+
+	body, err := newDecompressReader(ld.Codec, cipher.StreamReader{S: cipher.NewCTR(block, iv), R: in})
+	if err != nil {
+		return 0, fmt.Errorf("failed to set up %s decoder: %w", ld.Codec, err)
+	}
+	defer body.Close()
+
+	// Like fetchFromPeer, decrypt next to the output path and only move the file into place once it checks out
+	partPath := downloadPartPath(ld.OutputPath)
+	out, err := os.Create(partPath)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create output file: %w", err)
+	}
+	defer os.Remove(partPath) // no-op once renamed into place
+	written, err := io.Copy(out, body)
+	if err != nil {
+		out.Close()
+		return 0, fmt.Errorf("failed to decrypt download: %w", err)
+	}
+	if err := out.Close(); err != nil {
+		return 0, fmt.Errorf("failed to write output file: %w", err)
+	}
+
+	if err := verifyFileCID(partPath, ld.CID); err != nil {
+		return 0, fmt.Errorf("decrypted file failed verification: %w", err)
+	}
+	if err := os.Rename(partPath, ld.OutputPath); err != nil {
+		return 0, fmt.Errorf("failed to move output file into place: %w", err)
+	}
+	return written, nil
+}
+
+// Handler to pay for and decrypt a download that arrived encrypted
+func (h *dhtHandler) unlockTransferHandler(w http.ResponseWriter, r *http.Request) {
+	// Set CORS headers
+	w.Header().Set("Access-Control-Allow-Origin", "http://localhost:5173") // Change to your frontend's URL
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+
+	// Handle preflight OPTIONS request
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if _, err := h.unlockTransfer(r.Context(), r.URL.Query().Get("transferID"), r.URL.Query().Get("txid")); err != nil {
+		writeLegacyError(w, err)
+		return
+	}
+	w.Write([]byte("Successfully File Sent!"))
+}
+
+// unlockTransfer asks the seller of a locked download for its key, proving payment
+// with txid, then decrypts the file into place and starts seeding it.
+func (h *dhtHandler) unlockTransfer(ctx context.Context, transferID, txid string) (downloadRecord, error) {
+	if transferID == "" || txid == "" {
+		return downloadRecord{}, badRequest("transferID and txid are required")
+	}
+	if _, err := hex.DecodeString(txid); err != nil || len(txid) != 64 {
+		return downloadRecord{}, badRequest("invalid txid %q", txid)
+	}
+
+	ld, ok := catalog.LockedDownload(transferID)
+	if !ok {
+		return downloadRecord{}, notFound("unknown transfer")
+	}
+	seller, err := parsePeerID(ld.Seller)
+	if err != nil {
+		return downloadRecord{}, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 60*time.Second)
+	defer cancel()
+	if _, err := connectToPeerPreferDirect(ctx, h.node, h.kadDHT, seller); err != nil {
+		return downloadRecord{}, upstreamFailed("failed to reach seller: %v", err)
+	}
+	key, iv, s, err := requestTransferKey(ctx, h.node, seller, transferID, txid)
+	if err != nil {
+		log.Printf("Key release for transfer %s failed: %v", transferID, err)
+		if errors.Is(err, errKeyRefused) {
+			return downloadRecord{}, newAPIError(http.StatusPaymentRequired, errCodePaymentRequired, "%v", err)
+		}
+		return downloadRecord{}, upstreamFailed("%v", err)
+	}
+	defer s.Close()
+
+	written, err := unlockDownload(ld, key, iv)
+	if err != nil {
+		log.Printf("Failed to unlock transfer %s: %v", transferID, err)
+		if errors.Is(err, errCIDMismatch) {
+			recordTransfer(seller, 0, 0, err)
+			recordIntegrityFailure(seller, err)
+			return downloadRecord{}, newAPIError(http.StatusUnprocessableEntity, errCodeVerificationFailed, "%v", err)
+		}
+		return downloadRecord{}, err
+	}
+	recordTransfer(seller, written, ld.Elapsed, nil)
+	if keyReleaseHasReceipts(s.Protocol()) {
+		h.sendReceipt(s, ld.CID, written, transferID)
+	}
+	os.Remove(ld.LockedPath)
+	if err := catalog.RemoveLockedDownload(transferID); err != nil {
+		log.Printf("Failed to forget unlocked transfer %s: %v", transferID, err)
+	}
+	record := downloadRecord{CID: ld.CID, Path: ld.OutputPath, Peer: ld.Seller, CompletedAt: time.Now()}
+	catalog.RecordDownload(record)
+	h.seedDownload(ld.CID, ld.OutputPath)
+
+	log.Printf("Unlocked paid download of CID %s into '%s'", ld.CID, ld.OutputPath)
+	return record, nil
+}
+
+// paymentVerifier confirms that a transaction paid at least amount to address and
+// carries memo (the transfer ID) in an OP_RETURN output, so one payment is tied to
+// one transfer and can't be claimed for someone else's.
+type paymentVerifier interface {
+	VerifyPayment(ctx context.Context, txid, address string, amount float64, memo string) error
+}
+
+// bitcoinRPCVerifier checks payments against the same bitcoind JSON-RPC endpoint
+// the wallet service uses (RPC_URL, RPC_USER, RPC_PASSWORD).
+type bitcoinRPCVerifier struct {
+	url      string
+	user     string
+	password string
+	client   *http.Client
+}
+
+func newBitcoinRPCVerifierFromEnv() *bitcoinRPCVerifier {
+	return &bitcoinRPCVerifier{
+		url:      os.Getenv("RPC_URL"),
+		user:     os.Getenv("RPC_USER"),
+		password: os.Getenv("RPC_PASSWORD"),
+		client:   &http.Client{Timeout: 20 * time.Second},
+	}
+}
+
+func (v *bitcoinRPCVerifier) VerifyPayment(ctx context.Context, txid, address string, amount float64, memo string) error {
+	if v.url == "" {
+		return fmt.Errorf("payment verification is not configured (RPC_URL is unset)")
+	}
+	if address == "" {
+		return fmt.Errorf("listing has no wallet address")
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"jsonrpc": "1.0",
+		"id":      "orcanet",
+		"method":  "getrawtransaction",
+		"params":  []interface{}{txid, true},
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, v.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(v.user, v.password)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("rpc request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var rpcResp struct {
+		Result *struct {
+			Confirmations int `json:"confirmations"`
+			Vout          []struct {
+				Value        float64 `json:"value"`
+				ScriptPubKey struct {
+					Address   string   `json:"address"`
+					Addresses []string `json:"addresses"`
+					Type      string   `json:"type"`
+					Asm       string   `json:"asm"`
+				} `json:"scriptPubKey"`
+			} `json:"vout"`
+		} `json:"result"`
+		Error *struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&rpcResp); err != nil {
+		return fmt.Errorf("failed to decode rpc response: %w", err)
+	}
+	if rpcResp.Error != nil {
+		return fmt.Errorf("rpc error: %s", rpcResp.Error.Message)
+	}
+	if rpcResp.Result == nil {
+		return fmt.Errorf("transaction %s not found", txid)
+	}
+	if rpcResp.Result.Confirmations < minPaymentConfirmations {
+		return fmt.Errorf("transaction %s has %d confirmations, need %d", txid, rpcResp.Result.Confirmations, minPaymentConfirmations)
+	}
+
+	paid := 0.0
+	memoFound := false
+	for _, out := range rpcResp.Result.Vout {
+		if out.ScriptPubKey.Type == "nulldata" && out.ScriptPubKey.Asm == "OP_RETURN "+memo {
+			memoFound = true
+			continue
+		}
+		if out.ScriptPubKey.Address == address {
+			paid += out.Value
+			continue
+		}
+		for _, a := range out.ScriptPubKey.Addresses {
+			if a == address {
+				paid += out.Value
+				break
+			}
+		}
+	}
+	if !memoFound {
+		return fmt.Errorf("transaction %s has no OP_RETURN memo %s", txid, memo)
+	}
+	if paid < amount {
+		return fmt.Errorf("transaction %s pays %f to %s, price is %f", txid, paid, address, amount)
+	}
+	return nil
+}
+
+// Stores an encrypted payload as-is until its key has been bought
+func storeLockedDownload(r io.Reader, header transferHeader, seller peer.ID, cid, outputPath string, start time.Time) (*lockedDownload, int64, error) {
+	lockedPath := outputPath + ".locked"
+	file, err := os.Create(lockedPath)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to create locked download file: %w", err)
+	}
+	written, err := io.Copy(file, r)
+	file.Close()
+	if err != nil {
+		os.Remove(lockedPath)
+		return nil, 0, fmt.Errorf("failed to write locked download: %w", err)
+	}
+
+	ld := &lockedDownload{
+		TransferID:    header.TransferID,
+		CID:           cid,
+		Seller:        seller.String(),
+		Codec:         header.Codec,
+		Price:         header.Price,
+		WalletAddress: header.WalletAddress,
+		LockedPath:    lockedPath,
+		OutputPath:    outputPath,
+		Elapsed:       time.Since(start),
+	}
+	if err := catalog.AddLockedDownload(ld); err != nil {
+		os.Remove(lockedPath)
+		return nil, 0, fmt.Errorf("failed to record locked download: %w", err)
+	}
+	log.Printf("Received encrypted CID %s (%d bytes); pay %f to %s with memo %s and unlock the transfer", cid, written, ld.Price, ld.WalletAddress, ld.TransferID)
+	return ld, written, nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Keys a buyer may still pay for, spent payments and locked downloads all have to
+// outlive a restart
+func TestPaidTransfersSurviveRestart(t *testing.T) {
+	dir := t.TempDir()
+	dbPath, legacyPath := filepath.Join(dir, "test.db"), filepath.Join(dir, "legacy")
+	ms, err := openMetadataStoreAt(dbPath, legacyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tk, err := newTransferKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tk.CID, tk.Price = "cid", 1.5
+	if tk.Buyer, err = peer.Decode("12D3KooWDpJ7As7BWAwRMfu1VU2WCqNjvq387JEYKDBj4kx6nXTN"); err != nil {
+		t.Fatal(err)
+	}
+	id, err := ms.AddTransferKey(tk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ms.SpendPayment(id, "tx"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ms.AddLockedDownload(&lockedDownload{TransferID: "transfer", CID: "cid", LockedPath: "/tmp/x.locked", OutputPath: "/tmp/x"}); err != nil {
+		t.Fatal(err)
+	}
+	ms.Close()
+
+	ms, err = openMetadataStoreAt(dbPath, legacyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ms.Close()
+
+	got, ok := ms.TransferKey(id)
+	if !ok || string(got.Key) != string(tk.Key) || got.CID != "cid" || got.Price != 1.5 || got.Buyer != tk.Buyer {
+		t.Errorf("transfer key after restart: %+v, %v", got, ok)
+	}
+	if err := ms.SpendPayment(id, "tx"); err != nil {
+		t.Errorf("asking again for the same transfer: %v", err)
+	}
+	if err := ms.SpendPayment("other", "tx"); err == nil {
+		t.Error("a spent payment was accepted for another transfer after restart")
+	}
+	ld, ok := ms.LockedDownload("transfer")
+	if !ok || ld.LockedPath != "/tmp/x.locked" || ld.OutputPath != "/tmp/x" {
+		t.Errorf("locked download after restart: %+v, %v", ld, ok)
+	}
+	if err := ms.RemoveLockedDownload("transfer"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ms.LockedDownload("transfer"); ok {
+		t.Error("locked download still there after removal")
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"sync"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// Every orcanet stream protocol is registered under its current and previous semantic
+// version, listed here in order of preference. Clients pass the whole list to NewStream
+// so multistream-select settles on the newest version both sides speak. The unversioned
+// IDs older nodes used are kept as aliases of the previous version.
+const (
+	// 1.1.0 plus a signed delivery receipt from the buyer at the end
+	sendDataV1_2 = protocol.ID("/orcanet/senddata/1.2.0")
+	// Transfer header with negotiated codec and optional encryption
+	sendDataV1_1 = protocol.ID("/orcanet/senddata/1.1.0")
+	// Raw file bytes after a "peerID,cid" request
+	sendDataV1_0     = protocol.ID("/orcanet/senddata/1.0.0")
+	sendDataUnversed = protocol.ID("/senddata/p2p")
+
+	// JSON batch request (CIDs, prefix, tags, text) answered with every match at once
+	cidGetV1_2 = protocol.ID("/orcanet/cid-get/1.2.0")
+	// Codec-negotiated metadata response
+	cidGetV1_1 = protocol.ID("/orcanet/cid-get/1.1.0")
+	// Plain JSON metadata response
+	cidGetV1_0   = protocol.ID("/orcanet/cid-get/1.0.0")
+	cidGetLegacy = protocol.ID("/cid-get/1.0.0")
+
+	peerExchangeV1_0     = protocol.ID("/orcanet/peer-exchange/1.0.0")
+	peerExchangeUnversed = protocol.ID("/orcanet/p2p")
+
+	// 1.0.0 plus a signed delivery receipt from the buyer once the unlocked file checks out
+	keyReleaseV1_1 = protocol.ID("/orcanet/key-release/1.1.0")
+	// Key and IV for a confirmed payment
+	keyReleaseV1_0 = protocol.ID("/orcanet/key-release/1.0.0")
+)
+
+var (
+	sendDataProtocols     = []protocol.ID{sendDataV1_2, sendDataV1_1, sendDataV1_0, sendDataUnversed}
+	cidGetProtocols       = []protocol.ID{cidGetV1_2, cidGetV1_1, cidGetV1_0, cidGetLegacy}
+	peerExchangeProtocols = []protocol.ID{peerExchangeV1_0, peerExchangeUnversed}
+	keyReleaseProtocols   = []protocol.ID{keyReleaseV1_1, keyReleaseV1_0}
+)
+
+// Protocol families, keyed by the name diagnostics report them under
+var protocolFamilies = map[string][]protocol.ID{
+	"senddata":      sendDataProtocols,
+	"cid-get":       cidGetProtocols,
+	"peer-exchange": peerExchangeProtocols,
+	"key-release":   keyReleaseProtocols,
+}
+
+// Returns the semantic version in a protocol ID, or "0.0.0" for the unversioned legacy IDs
+func protocolVersion(id protocol.ID) string {
+	switch id {
+	case sendDataUnversed, peerExchangeUnversed:
+		return "0.0.0"
+	}
+	return path.Base(string(id))
+}
+
+// Whether a senddata version carries the codec list and transfer header
+func sendDataNegotiates(id protocol.ID) bool {
+	return id == sendDataV1_2 || id == sendDataV1_1
+}
+
+// Whether a senddata version ends with a delivery receipt
+func sendDataHasReceipts(id protocol.ID) bool {
+	return id == sendDataV1_2
+}
+
+// Whether a key-release version ends with a delivery receipt
+func keyReleaseHasReceipts(id protocol.ID) bool {
+	return id == keyReleaseV1_1
+}
+
+// Registers handler under every version of a protocol family
+func setVersionedStreamHandler(node host.Host, ids []protocol.ID, handler network.StreamHandler) {
+	for _, id := range ids {
+		node.SetStreamHandler(id, handler)
+	}
+}
+
+// negotiatedVersions remembers the version last agreed with each peer per family
+var negotiatedVersions = struct {
+	sync.Mutex
+	byPeer map[peer.ID]map[string]protocol.ID
+}{byPeer: make(map[peer.ID]map[string]protocol.ID)}
+
+func recordNegotiated(p peer.ID, family string, id protocol.ID) {
+	negotiatedVersions.Lock()
+	defer negotiatedVersions.Unlock()
+	if negotiatedVersions.byPeer[p] == nil {
+		negotiatedVersions.byPeer[p] = make(map[string]protocol.ID)
+	}
+	if prev := negotiatedVersions.byPeer[p][family]; prev != id {
+		log.Printf("Negotiated %s %s with %s", family, protocolVersion(id), p)
+	}
+	negotiatedVersions.byPeer[p][family] = id
+}
+
+type protocolDiagnostics struct {
+	Family     string   `json:"family"`
+	Supported  []string `json:"supported,omitempty"` // versions the peer announced via identify
+	Negotiated string   `json:"negotiated,omitempty"`
+	Version    string   `json:"version,omitempty"`
+}
+
+// Handler reporting the protocol versions we speak and, with ?peer=, what a peer
+// supports and which version we last negotiated with it
+func (h *dhtHandler) protocolDiagnosticsHandler(w http.ResponseWriter, r *http.Request) {
+	// Set CORS headers
+	w.Header().Set("Access-Control-Allow-Origin", "http://localhost:5173") // Change to your frontend's URL
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+
+	// Handle preflight OPTIONS request
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	var target peer.ID
+	if p := r.URL.Query().Get("peer"); p != "" {
+		id, err := parsePeerID(p)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		target = id
+	}
+
+	negotiated := make(map[string]protocol.ID)
+	negotiatedVersions.Lock()
+	for family, id := range negotiatedVersions.byPeer[target] {
+		negotiated[family] = id
+	}
+	negotiatedVersions.Unlock()
+
+	var report []protocolDiagnostics
+	for family, ids := range protocolFamilies {
+		d := protocolDiagnostics{Family: family}
+		if target == "" {
+			for _, id := range ids {
+				d.Supported = append(d.Supported, string(id))
+			}
+		} else {
+			supported, err := h.node.Peerstore().SupportsProtocols(target, ids...)
+			if err == nil {
+				for _, id := range supported {
+					d.Supported = append(d.Supported, string(id))
+				}
+			}
+			if id, ok := negotiated[family]; ok {
+				d.Negotiated = string(id)
+				d.Version = protocolVersion(id)
+			}
+		}
+		report = append(report, d)
+	}
+
+	sort.Slice(report, func(i, j int) bool { return report[i].Family < report[j].Family })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// How many providers are asked for their metadata at once, and how long each one gets
+const (
+	providerQueryConcurrency = 8
+	providerQueryTimeout     = 15 * time.Second
+)
+
+// Per-peer outcome of a provider metadata query
+const (
+	providerOK          = "ok"
+	providerTimeout     = "timeout"
+	providerUnreachable = "unreachable"
+	providerDecodeError = "decode_error"
+)
+
+// One provider's answer to a metadata query, or why there isn't one, along with what
+// we've seen of the peer before
+type providerResult struct {
+	PeerIDs
+	Status     string          `json:"status"`
+	Error      string          `json:"error,omitempty"`
+	LatencyMs  float64         `json:"latency_ms,omitempty"` // how long this query took
+	Score      float64         `json:"score"`
+	Reputation *peerReputation `json:"reputation,omitempty"`
+}
+
+// queryCIDFromPeers asks every peer for its metadata on targetCID, a few at a time.
+// Each peer gets providerQueryTimeout within ctx's deadline; a peer that fails doesn't
+// hold up the rest and comes back with a status saying why. How each peer answered
+// goes into its reputation. Results keep the order of peers.
+func queryCIDFromPeers(ctx context.Context, node host.Host, peers []peer.ID, targetCID string) []providerResult {
+	results := make([]providerResult, len(peers))
+	sem := make(chan struct{}, providerQueryConcurrency)
+	var wg sync.WaitGroup
+	for i, peerID := range peers {
+		wg.Add(1)
+		go func(i int, peerID peer.ID) {
+			defer wg.Done()
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			case <-ctx.Done():
+				results[i] = providerFailure(peerID, ctx.Err())
+				return
+			}
+			start := time.Now()
+			results[i] = queryCIDFromPeer(ctx, node, peerID, targetCID)
+			elapsed := time.Since(start)
+			if results[i].Status == providerOK {
+				results[i].LatencyMs = float64(elapsed.Milliseconds())
+			}
+			if !errors.Is(ctx.Err(), context.Canceled) {
+				recordQuery(peerID, elapsed, results[i].Status == providerOK)
+			}
+		}(i, peerID)
+	}
+	wg.Wait()
+
+	for i, peerID := range peers {
+		rep := catalog.Reputation(peerID)
+		results[i].Score = rep.score()
+		results[i].Reputation = &rep
+	}
+	return results
+}
+
+// How /providers/ narrows and orders what the providers answered
+type providerQuery struct {
+	MaxPrice       *float64 // drop listings priced above this
+	Sort           string   // "" (as found), price, latency or reputation
+	Limit          int      // 0 for no limit
+	IncludeOffline bool     // keep providers that didn't answer, with their status
+}
+
+// Reads ?maxprice=, ?sort=, ?limit= and ?offline=. Providers that didn't answer are
+// listed unless ?offline=false.
+func providerQueryFromValues(values url.Values) (providerQuery, error) {
+	pq := providerQuery{IncludeOffline: true}
+	if v := values.Get("maxprice"); v != "" {
+		price, err := strconv.ParseFloat(v, 64)
+		if err != nil || price < 0 {
+			return pq, badRequest("invalid maxprice %q", v)
+		}
+		pq.MaxPrice = &price
+	}
+	switch pq.Sort = values.Get("sort"); pq.Sort {
+	case "", "price", "latency", "reputation":
+	case "score": // what this option was called before price and latency sorting
+		pq.Sort = "reputation"
+	default:
+		return pq, badRequest("unknown sort %q, expected price, latency or reputation", pq.Sort)
+	}
+	if v := values.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 0 {
+			return pq, badRequest("invalid limit %q", v)
+		}
+		pq.Limit = limit
+	}
+	if v := values.Get("offline"); v != "" {
+		offline, err := strconv.ParseBool(v)
+		if err != nil {
+			return pq, badRequest("invalid offline %q", v)
+		}
+		pq.IncludeOffline = offline
+	}
+	return pq, nil
+}
+
+// Cheapest listing a provider offered, or +Inf if it offered none
+func lowestPrice(result providerResult) float64 {
+	lowest := math.Inf(1)
+	for _, m := range result.Metadata {
+		lowest = math.Min(lowest, m.Price)
+	}
+	return lowest
+}
+
+// apply filters the aggregated results and ranks what is left. Providers that didn't
+// answer have no price or latency to compare, so they sort after the rest.
+func (pq providerQuery) apply(results []providerResult) []providerResult {
+	kept := []providerResult{}
+	for _, result := range results {
+		if result.Status != providerOK {
+			if pq.IncludeOffline {
+				kept = append(kept, result)
+			}
+			continue
+		}
+		if pq.MaxPrice != nil {
+			affordable := []FileMetadata{}
+			for _, m := range result.Metadata {
+				if m.Price <= *pq.MaxPrice {
+					affordable = append(affordable, m)
+				}
+			}
+			if len(affordable) == 0 {
+				continue
+			}
+			result.Metadata = affordable
+		}
+		kept = append(kept, result)
+	}
+
+	var less func(a, b providerResult) bool
+	switch pq.Sort {
+	case "price":
+		less = func(a, b providerResult) bool { return lowestPrice(a) < lowestPrice(b) }
+	case "latency":
+		less = func(a, b providerResult) bool { return a.LatencyMs < b.LatencyMs }
+	case "reputation":
+		less = func(a, b providerResult) bool { return a.Score > b.Score }
+	}
+	if less != nil {
+		sort.SliceStable(kept, func(i, j int) bool {
+			a, b := kept[i], kept[j]
+			if (a.Status == providerOK) != (b.Status == providerOK) {
+				return a.Status == providerOK
+			}
+			return less(a, b)
+		})
+	}
+
+	if pq.Limit > 0 && len(kept) > pq.Limit {
+		kept = kept[:pq.Limit]
+	}
+	return kept
+}
+
+func providerFailure(peerID peer.ID, err error) providerResult {
+	status := providerUnreachable
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+		status = providerTimeout
+	}
+	return providerResult{
+		PeerIDs: PeerIDs{PeerID: peerID.String(), Metadata: []FileMetadata{}},
+		Status:  status,
+		Error:   err.Error(),
+	}
+}
+
+func queryCIDFromPeer(ctx context.Context, node host.Host, peerID peer.ID, targetCID string) providerResult {
+	log.Printf("Querying peer: %s for CID: %s", peerID.String(), targetCID)
+	ctx, cancel := context.WithTimeout(ctx, providerQueryTimeout)
+	defer cancel()
+
+	// Open a stream to the peer
+	s, err := node.NewStream(ctx, peerID, cidGetProtocols...)
+	if err != nil {
+		log.Printf("Failed to open stream to peer %s: %v", peerID, err)
+		return providerFailure(peerID, err)
+	}
+	defer s.Close()
+	// Reads and writes give up when the peer's time is up or the caller goes away
+	if deadline, ok := ctx.Deadline(); ok {
+		s.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { s.Reset() })
+	defer stop()
+
+	recordNegotiated(peerID, "cid-get", s.Protocol())
+	negotiate := s.Protocol() == cidGetV1_1 || s.Protocol() == cidGetV1_2
+
+	// Send the CID query; from 1.2.0 on it is a batch of one
+	query := []byte(targetCID + "\n")
+	switch s.Protocol() {
+	case cidGetV1_2:
+		query, err = encodeCIDBatchRequest(cidBatchRequest{CIDs: []string{targetCID}})
+	case cidGetV1_1:
+		query = []byte(targetCID + "," + acceptedCodecs() + "\n")
+	}
+	if err == nil {
+		_, err = s.Write(query)
+	}
+	if err != nil {
+		log.Printf("Error sending CID query to peer %s: %v", peerID, err)
+		return providerFailure(peerID, contextOr(ctx, err))
+	}
+
+	// Read the response
+	var responseData []byte
+	if negotiate {
+		responseData, err = readEncoded(s)
+	} else {
+		responseData, err = readAllLimited(s, maxMetadataResponseSize)
+	}
+	if err != nil {
+		log.Printf("Error reading response from peer %s: %v", peerID, err)
+		return providerFailure(peerID, contextOr(ctx, err))
+	}
+
+	// Decode the response into a structured format
+	result := providerResult{Status: providerOK}
+	if err := json.Unmarshal(responseData, &result.PeerIDs); err != nil {
+		log.Printf("Error decoding response from peer %s: %v", peerID, err)
+		return providerResult{
+			PeerIDs: PeerIDs{PeerID: peerID.String(), Metadata: []FileMetadata{}},
+			Status:  providerDecodeError,
+			Error:   err.Error(),
+		}
+	}
+	// The answer is keyed by the peer we asked, whatever it claims to be
+	result.PeerID = peerID.String()
+	if result.Metadata == nil {
+		result.Metadata = []FileMetadata{}
+	}
+	return result
+}
+
+// A stream reset because ctx ended shows up as a reset error; report the context's reason instead
+func contextOr(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+// Providers that timed out or couldn't be reached are listed with their status unless
+// the query asks to leave them out
+func TestProviderQueryKeepsOfflineByDefault(t *testing.T) {
+	results := []providerResult{
+		{PeerIDs: PeerIDs{PeerID: "timeout", Metadata: []FileMetadata{}}, Status: providerTimeout},
+		{PeerIDs: PeerIDs{PeerID: "ok", Metadata: []FileMetadata{{Price: 2}}}, Status: providerOK},
+		{PeerIDs: PeerIDs{PeerID: "unreachable", Metadata: []FileMetadata{}}, Status: providerUnreachable},
+		{PeerIDs: PeerIDs{PeerID: "decode", Metadata: []FileMetadata{}}, Status: providerDecodeError},
+	}
+
+	for _, tc := range []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{"timeout", "ok", "unreachable", "decode"}},
+		{"sort=price", []string{"ok", "timeout", "unreachable", "decode"}},
+		{"offline=false", []string{"ok"}},
+		{"maxprice=1", []string{"timeout", "unreachable", "decode"}},
+	} {
+		values, err := url.ParseQuery(tc.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pq, err := providerQueryFromValues(values)
+		if err != nil {
+			t.Fatalf("%q: %v", tc.query, err)
+		}
+		got := pq.apply(results)
+		if len(got) != len(tc.want) {
+			t.Errorf("%q: got %d providers, want %v", tc.query, len(got), tc.want)
+			continue
+		}
+		for i, result := range got {
+			if result.PeerID != tc.want[i] {
+				t.Errorf("%q: provider %d is %s, want %s", tc.query, i, result.PeerID, tc.want[i])
+			}
+			if result.Metadata == nil {
+				t.Errorf("%q: %s has nil metadata", tc.query, result.PeerID)
+			}
+		}
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	bolt "go.etcd.io/bbolt"
+)
+
+const receiptDomain = "orcanet-delivery-receipt/v1"
+
+// deliveryReceipt is the buyer's signed statement that a transfer completed and the
+// content matched its CID. It is exchanged at the end of a senddata 1.2.0 stream, or
+// of a key-release 1.1.0 stream for paid files, and kept by both sides.
+type deliveryReceipt struct {
+	CID        string `json:"cid"`
+	Bytes      int64  `json:"bytes"` // content bytes, once decompressed and decrypted
+	Timestamp  int64  `json:"timestamp"`
+	Seller     string `json:"seller"`
+	Buyer      string `json:"buyer"`
+	TransferID string `json:"transfer_id,omitempty"` // set for encrypted transfers
+	Signature  []byte `json:"signature"`
+}
+
+// The bytes the buyer signs: every field but the signature, in a fixed order
+func (dr deliveryReceipt) signedPayload() []byte {
+	return []byte(strings.Join([]string{
+		receiptDomain,
+		dr.CID,
+		strconv.FormatInt(dr.Bytes, 10),
+		strconv.FormatInt(dr.Timestamp, 10),
+		dr.Seller,
+		dr.Buyer,
+		dr.TransferID,
+	}, "\n"))
+}
+
+func signReceipt(key crypto.PrivKey, dr deliveryReceipt) (deliveryReceipt, error) {
+	if key == nil {
+		return dr, fmt.Errorf("no private key to sign the receipt with")
+	}
+	sig, err := key.Sign(dr.signedPayload())
+	if err != nil {
+		return dr, fmt.Errorf("failed to sign receipt: %w", err)
+	}
+	dr.Signature = sig
+	return dr, nil
+}
+
+// verifyReceipt checks the signature against the public key embedded in the buyer's peer ID
+func verifyReceipt(dr deliveryReceipt) error {
+	buyer, err := peer.Decode(dr.Buyer)
+	if err != nil {
+		return fmt.Errorf("invalid buyer peer ID: %w", err)
+	}
+	if _, err := peer.Decode(dr.Seller); err != nil {
+		return fmt.Errorf("invalid seller peer ID: %w", err)
+	}
+	pub, err := buyer.ExtractPublicKey()
+	if err != nil {
+		return fmt.Errorf("can't get the buyer's public key from its peer ID: %w", err)
+	}
+	ok, err := pub.Verify(dr.signedPayload(), dr.Signature)
+	if err != nil {
+		return fmt.Errorf("failed to verify signature: %w", err)
+	}
+	if !ok {
+		return fmt.Errorf("signature does not match receipt")
+	}
+	return nil
+}
+
+// Receipt as stored locally, with which side of the transfer we were on
+type storedReceipt struct {
+	Role    string          `json:"role"` // "seller" or "buyer"
+	Receipt deliveryReceipt `json:"receipt"`
+}
+
+// Path of the JSON array older versions kept receipts in
+func getLegacyReceiptsPath() (string, error) {
+	downloadPath, err := getDownloadPath()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(downloadPath, node_id+"-receipts.json"), nil
+}
+
+// Moves the receipts in the legacy JSON file at path into the receipts bucket
+func (ms *metadataStore) migrateLegacyReceipts(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read legacy receipts: %w", err)
+	}
+	var legacy []storedReceipt
+	if err := json.Unmarshal(data, &legacy); err != nil {
+		return fmt.Errorf("failed to parse legacy receipts: %w", err)
+	}
+	err = ms.db.Update(func(tx *bolt.Tx) error {
+		for _, sr := range legacy {
+			if err := putReceipt(tx, sr); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to migrate legacy receipts: %w", err)
+	}
+	if err := os.Rename(path, path+".migrated"); err != nil {
+		return fmt.Errorf("failed to retire legacy receipts file: %w", err)
+	}
+	log.Printf("Migrated %d delivery receipts from %s into the metadata database", len(legacy), path)
+	return nil
+}
+
+// Appends sr under the bucket's next sequence number. Must be called in a write transaction.
+func putReceipt(tx *bolt.Tx, sr storedReceipt) error {
+	bucket := tx.Bucket(receiptsBucket)
+	seq, err := bucket.NextSequence()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(sr)
+	if err != nil {
+		return fmt.Errorf("failed to encode receipt: %w", err)
+	}
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return bucket.Put(key, data)
+}
+
+func (ms *metadataStore) AddReceipt(role string, dr deliveryReceipt) error {
+	err := ms.db.Update(func(tx *bolt.Tx) error {
+		return putReceipt(tx, storedReceipt{Role: role, Receipt: dr})
+	})
+	if err != nil {
+		return fmt.Errorf("failed to store receipt: %w", err)
+	}
+	return nil
+}
+
+// Receipts in the order they were stored, for cid and role if they aren't empty
+func (ms *metadataStore) Receipts(cid, role string) ([]storedReceipt, error) {
+	receipts := []storedReceipt{}
+	err := ms.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(receiptsBucket).ForEach(func(k, v []byte) error {
+			var sr storedReceipt
+			if err := json.Unmarshal(v, &sr); err != nil {
+				return fmt.Errorf("failed to parse receipt %x: %w", k, err)
+			}
+			if (cid == "" || sr.Receipt.CID == cid) && (role == "" || sr.Role == role) {
+				receipts = append(receipts, sr)
+			}
+			return nil
+		})
+	})
+	return receipts, err
+}
+
+func newReceipt(cid string, bytes int64, seller, buyer peer.ID, transferID string) deliveryReceipt {
+	return deliveryReceipt{
+		CID:        cid,
+		Bytes:      bytes,
+		Timestamp:  time.Now().Unix(),
+		Seller:     seller.String(),
+		Buyer:      buyer.String(),
+		TransferID: transferID,
+	}
+}
+
+// Checks a receipt a buyer sent back against what we actually served
+func checkIncomingReceipt(dr deliveryReceipt, cid string, bytes int64, seller, buyer peer.ID) error {
+	if err := verifyReceipt(dr); err != nil {
+		return err
+	}
+	switch {
+	case dr.CID != cid:
+		return fmt.Errorf("receipt is for CID %s, served %s", dr.CID, cid)
+	case dr.Seller != seller.String():
+		return fmt.Errorf("receipt names seller %s", dr.Seller)
+	case dr.Buyer != buyer.String():
+		return fmt.Errorf("receipt signed by %s, served %s", dr.Buyer, buyer)
+	case dr.Bytes != bytes:
+		return fmt.Errorf("receipt covers %d bytes, sent %d", dr.Bytes, bytes)
+	}
+	return nil
+}
+
+// Handler to list stored receipts, optionally filtered by ?cid= and ?role=
+func (h *dhtHandler) listReceiptsHandler(w http.ResponseWriter, r *http.Request) {
+	// Set CORS headers
+	w.Header().Set("Access-Control-Allow-Origin", "http://localhost:5173") // Change to your frontend's URL
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+
+	// Handle preflight OPTIONS request
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	receipts, err := catalog.Receipts(r.URL.Query().Get("cid"), r.URL.Query().Get("role"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(receipts)
+}
+
+// Handler to verify a receipt posted as JSON, e.g. one the other side of a dispute presents
+func (h *dhtHandler) verifyReceiptHandler(w http.ResponseWriter, r *http.Request) {
+	// Set CORS headers
+	w.Header().Set("Access-Control-Allow-Origin", "http://localhost:5173") // Change to your frontend's URL
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+
+	// Handle preflight OPTIONS request
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	var dr deliveryReceipt
+	if err := json.NewDecoder(r.Body).Decode(&dr); err != nil {
+		http.Error(w, "Invalid receipt JSON", http.StatusBadRequest)
+		return
+	}
+
+	result := struct {
+		Valid bool   `json:"valid"`
+		Error string `json:"error,omitempty"`
+	}{Valid: true}
+	if err := verifyReceipt(dr); err != nil {
+		result.Valid = false
+		result.Error = err.Error()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// How long a buyer gets to send its receipt, on top of the time it needs to hash what
+// it received at receiptHashRate
+const (
+	receiptTimeout  = 30 * time.Second
+	receiptHashRate = 16 << 20 // bytes per second
+)
+
+// collectReceipt half-closes the stream so the buyer sees the end of the payload, then
+// waits for its signed receipt, checks it against the content bytes sent and stores it.
+func collectReceipt(s network.Stream, r *bufio.Reader, cid string, sent int64, transferID string) {
+	if err := s.CloseWrite(); err != nil {
+		log.Printf("Failed to close write side for receipt: %v", err)
+		return
+	}
+	// The buyer only signs once it has checked the content against the CID
+	s.SetReadDeadline(time.Now().Add(receiptTimeout + time.Duration(sent/receiptHashRate)*time.Second))
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		log.Printf("No delivery receipt from %s for CID %s: %v", s.Conn().RemotePeer(), cid, err)
+		return
+	}
+	var dr deliveryReceipt
+	if err := json.Unmarshal(line, &dr); err != nil {
+		log.Printf("Malformed delivery receipt from %s: %v", s.Conn().RemotePeer(), err)
+		return
+	}
+	if err := checkIncomingReceipt(dr, cid, sent, s.Conn().LocalPeer(), s.Conn().RemotePeer()); err != nil {
+		log.Printf("Rejected delivery receipt from %s: %v", s.Conn().RemotePeer(), err)
+		return
+	}
+	if dr.TransferID != transferID {
+		log.Printf("Rejected delivery receipt from %s: wrong transfer ID", s.Conn().RemotePeer())
+		return
+	}
+	if err := catalog.AddReceipt("seller", dr); err != nil {
+		log.Printf("%v", err)
+		return
+	}
+	log.Printf("Stored delivery receipt from %s for CID %s (%d bytes)", dr.Buyer, cid, dr.Bytes)
+}
+
+// sendReceipt signs a receipt for content we received and checked, sends it to the
+// seller and keeps a copy.
+func (h *dhtHandler) sendReceipt(s network.Stream, cid string, received int64, transferID string) {
+	key := h.node.Peerstore().PrivKey(h.node.ID())
+	dr, err := signReceipt(key, newReceipt(cid, received, s.Conn().RemotePeer(), h.node.ID(), transferID))
+	if err != nil {
+		log.Printf("%v", err)
+		return
+	}
+	data, err := json.Marshal(dr)
+	if err != nil {
+		log.Printf("Failed to encode receipt: %v", err)
+		return
+	}
+	if _, err := s.Write(append(data, '\n')); err != nil {
+		log.Printf("Failed to send delivery receipt: %v", err)
+		return
+	}
+	s.CloseWrite()
+	if err := catalog.AddReceipt("buyer", dr); err != nil {
+		log.Printf("%v", err)
+	}
+}
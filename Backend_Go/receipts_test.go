@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Receipts from the legacy JSON file come first, then new ones in the order they were stored
+func TestReceiptsStoredInOrder(t *testing.T) {
+	ms := openTestStore(t)
+
+	legacyPath := filepath.Join(t.TempDir(), "receipts.json")
+	legacy := []storedReceipt{{Role: "buyer", Receipt: deliveryReceipt{CID: "a", Bytes: 1}}}
+	data, err := json.Marshal(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(legacyPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ms.migrateLegacyReceipts(legacyPath); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(legacyPath); !os.IsNotExist(err) {
+		t.Errorf("legacy receipts file was left in place: %v", err)
+	}
+
+	for _, sr := range []storedReceipt{
+		{Role: "seller", Receipt: deliveryReceipt{CID: "b", Bytes: 2}},
+		{Role: "buyer", Receipt: deliveryReceipt{CID: "a", Bytes: 3}},
+	} {
+		if err := ms.AddReceipt(sr.Role, sr.Receipt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		cid, role string
+		want      []int64 // Bytes of the receipts expected, in order
+	}{
+		{"", "", []int64{1, 2, 3}},
+		{"a", "", []int64{1, 3}},
+		{"", "seller", []int64{2}},
+		{"b", "buyer", nil},
+	} {
+		receipts, err := ms.Receipts(tc.cid, tc.role)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []int64
+		for _, sr := range receipts {
+			got = append(got, sr.Receipt.Bytes)
+		}
+		if len(got) != len(tc.want) {
+			t.Errorf("cid %q role %q: got %v, want %v", tc.cid, tc.role, got, tc.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tc.want[i] {
+				t.Errorf("cid %q role %q: got %v, want %v", tc.cid, tc.role, got, tc.want)
+				break
+			}
+		}
+	}
+}
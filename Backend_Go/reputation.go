@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Weight of the newest sample in the throughput and latency moving averages
+const reputationSmoothing = 0.3
+
+// What we have seen of one peer as a seller. Throughput and latency are moving
+// averages, so a peer that improves (or gets worse) shows it within a few transfers.
+type peerReputation struct {
+	Peer              string    `json:"peer_id"`
+	Transfers         int64     `json:"transfers"`          // files fetched from the peer
+	FailedTransfers   int64     `json:"failed_transfers"`   // fetches that broke off or never started
+	IntegrityFailures int64     `json:"integrity_failures"` // files that didn't match their CID
+	Queries           int64     `json:"queries"`            // metadata queries answered
+	FailedQueries     int64     `json:"failed_queries"`
+	ThroughputBps     float64   `json:"throughput_bps,omitempty"`
+	LatencyMs         float64   `json:"latency_ms,omitempty"`
+	UpdatedAt         time.Time `json:"updated_at"`
+}
+
+func smooth(average, sample float64) float64 {
+	if average == 0 {
+		return sample
+	}
+	return average + reputationSmoothing*(sample-average)
+}
+
+// score rates the peer from 0 to 1, with 0.5 for a peer we know nothing about. Failed
+// transfers and queries pull it down gradually; each file that didn't match its CID
+// halves it, since that's a seller serving the wrong content.
+func (rep peerReputation) score() float64 {
+	// Success rates start from one success and one failure so a single outcome can't decide them
+	reliability := float64(rep.Transfers+1) / float64(rep.Transfers+rep.FailedTransfers+2)
+	responsiveness := float64(rep.Queries+1) / float64(rep.Queries+rep.FailedQueries+2)
+
+	speed := 0.5 // 1 MiB/s scores 0.5
+	if rep.ThroughputBps > 0 {
+		speed = rep.ThroughputBps / (rep.ThroughputBps + 1<<20)
+	}
+	latency := 0.5 // 500ms scores 0.5
+	if rep.LatencyMs > 0 {
+		latency = 500 / (500 + rep.LatencyMs)
+	}
+
+	score := 0.5*reliability + 0.2*responsiveness + 0.2*speed + 0.1*latency
+	score *= math.Pow(0.5, float64(rep.IntegrityFailures))
+	return math.Round(score*1000) / 1000
+}
+
+func (ms *metadataStore) Reputation(p peer.ID) peerReputation {
+	rep := peerReputation{Peer: p.String()}
+	ms.db.View(func(tx *bolt.Tx) error {
+		if data := tx.Bucket(reputationBucket).Get([]byte(p.String())); data != nil {
+			json.Unmarshal(data, &rep)
+		}
+		return nil
+	})
+	return rep
+}
+
+func (ms *metadataStore) Reputations() ([]peerReputation, error) {
+	reps := []peerReputation{}
+	err := ms.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(reputationBucket).ForEach(func(k, v []byte) error {
+			var rep peerReputation
+			if err := json.Unmarshal(v, &rep); err != nil {
+				return fmt.Errorf("failed to parse reputation of %s: %w", k, err)
+			}
+			reps = append(reps, rep)
+			return nil
+		})
+	})
+	return reps, err
+}
+
+// Applies fn to the peer's record in one transaction, so concurrent updates don't lose counts
+func (ms *metadataStore) updateReputation(p peer.ID, fn func(*peerReputation)) {
+	err := ms.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(reputationBucket)
+		rep := peerReputation{Peer: p.String()}
+		if data := bucket.Get([]byte(p.String())); data != nil {
+			if err := json.Unmarshal(data, &rep); err != nil {
+				return err
+			}
+		}
+		fn(&rep)
+		rep.UpdatedAt = time.Now()
+		data, err := json.Marshal(rep)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(p.String()), data)
+	})
+	if err != nil {
+		log.Printf("Failed to update reputation of %s: %v", p, err)
+	}
+}
+
+// Records how a fetch from the peer went, once what arrived has been checked against
+// its CID: content that didn't match makes it a failed transfer. Fetches we called off
+// ourselves don't count against the peer.
+func recordTransfer(p peer.ID, written int64, elapsed time.Duration, err error) {
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	catalog.updateReputation(p, func(rep *peerReputation) {
+		if err != nil {
+			rep.FailedTransfers++
+			return
+		}
+		rep.Transfers++
+		if seconds := elapsed.Seconds(); seconds > 0 && written > 0 {
+			rep.ThroughputBps = smooth(rep.ThroughputBps, float64(written)/seconds)
+		}
+	})
+}
+
+// Records that content from the peer failed verification, if that's what err says
+func recordIntegrityFailure(p peer.ID, err error) {
+	if !errors.Is(err, errCIDMismatch) {
+		return
+	}
+	log.Printf("Peer %s served content that doesn't match its CID", p)
+	catalog.updateReputation(p, func(rep *peerReputation) {
+		rep.IntegrityFailures++
+	})
+}
+
+// Records how long the peer took to answer a metadata query, or that it didn't
+func recordQuery(p peer.ID, elapsed time.Duration, ok bool) {
+	catalog.updateReputation(p, func(rep *peerReputation) {
+		if !ok {
+			rep.FailedQueries++
+			return
+		}
+		rep.Queries++
+		rep.LatencyMs = smooth(rep.LatencyMs, float64(elapsed.Milliseconds()))
+	})
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// A fetch whose content didn't match its CID is a failed transfer, never a success
+func TestIntegrityFailureCountsAsFailedTransfer(t *testing.T) {
+	saved := catalog
+	catalog = openTestStore(t)
+	defer func() { catalog = saved }()
+
+	p, err := peer.Decode("12D3KooWDpJ7As7BWAwRMfu1VU2WCqNjvq387JEYKDBj4kx6nXTN")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mismatch := fmt.Errorf("received file failed verification: %w", errCIDMismatch)
+	recordTransfer(p, 1<<20, time.Second, mismatch)
+	recordIntegrityFailure(p, mismatch)
+
+	rep := catalog.Reputation(p)
+	if rep.Transfers != 0 || rep.FailedTransfers != 1 || rep.IntegrityFailures != 1 {
+		t.Errorf("got %d transfers, %d failed, %d integrity failures; want 0, 1, 1", rep.Transfers, rep.FailedTransfers, rep.IntegrityFailures)
+	}
+	if rep.ThroughputBps != 0 {
+		t.Errorf("a failed transfer set throughput to %v", rep.ThroughputBps)
+	}
+	if unknown := (peerReputation{}).score(); rep.score() >= unknown {
+		t.Errorf("score %v after an integrity failure, unknown peers score %v", rep.score(), unknown)
+	}
+}
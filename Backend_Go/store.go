@@ -0,0 +1,587 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// The node's metadata lives in one bbolt database next to the downloads. Shared files
+// are keyed by CID with a second bucket mapping file paths back to CIDs, downloads are
+// keyed by CID and settings by name. The integrity scanner's results are keyed by CID
+// and the files picked up from watched folders by path. Computed CIDs are cached by path
+// and addressing options, and what we've seen of other peers as sellers by peer ID.
+// Paid transfers keep the seller's unreleased keys by transfer ID, the payments spent
+// on them by txid, and the buyer's downloads still waiting for a key by transfer ID.
+// Delivery receipts are keyed by a sequence number, in the order they were stored.
+// Every value is JSON.
+var (
+	filesBucket       = []byte("files")
+	filesByPathBucket = []byte("files_by_path")
+	downloadsBucket   = []byte("downloads")
+	settingsBucket    = []byte("settings")
+	integrityBucket   = []byte("integrity")
+	watchedBucket     = []byte("watched_files")
+	hashCacheBucket   = []byte("hash_cache")
+	reputationBucket  = []byte("reputation")
+
+	transferKeysBucket    = []byte("transfer_keys")
+	spentPaymentsBucket   = []byte("spent_payments")
+	lockedDownloadsBucket = []byte("locked_downloads")
+	receiptsBucket        = []byte("receipts")
+)
+
+// Version of the FileMetadata layout stored in the files bucket, kept under this
+// setting. Each migration brings the store from its index to index+1.
+const (
+	schemaVersionSetting = "schema_version"
+	currentSchemaVersion = 1
+)
+
+var schemaMigrations = []func(tx *bolt.Tx) error{
+	// 0 -> 1: file name, size, MIME type, timestamps, tags and download count
+	func(tx *bolt.Tx) error {
+		now := time.Now()
+		return rewriteFileMetadata(tx, func(metadata *FileMetadata) {
+			fillFileDetails(metadata, now)
+		})
+	},
+}
+
+// metadataStore is the one handle on the metadata database. HTTP handlers and stream
+// handlers all go through it. Every method runs in a single bbolt transaction: bbolt
+// admits one writer at a time and commits copy-on-write, so concurrent advertisements
+// can't lose each other's entries and readers never see a half-applied change.
+type metadataStore struct {
+	db *bolt.DB
+}
+
+// The node's metadata store, opened in main
+var catalog *metadataStore
+
+// A file we fetched and verified
+type downloadRecord struct {
+	CID         string    `json:"cid"`
+	Path        string    `json:"path"`
+	Peer        string    `json:"peer"`
+	Size        int64     `json:"size"`
+	CompletedAt time.Time `json:"completed_at"`
+}
+
+func getMetadataDBPath() (string, error) {
+	downloadPath, err := getDownloadPath()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(downloadPath, node_id+".db"), nil
+}
+
+// Path of the JSON array older versions kept the shared-file catalog in
+func getLegacyMetadataPath() (string, error) {
+	downloadPath, err := getDownloadPath()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(downloadPath, node_id), nil
+}
+
+func openMetadataStore() (*metadataStore, error) {
+	path, err := getMetadataDBPath()
+	if err != nil {
+		return nil, err
+	}
+	legacyPath, err := getLegacyMetadataPath()
+	if err != nil {
+		return nil, err
+	}
+	ms, err := openMetadataStoreAt(path, legacyPath)
+	if err != nil {
+		return nil, err
+	}
+	receiptsPath, err := getLegacyReceiptsPath()
+	if err == nil {
+		err = ms.migrateLegacyReceipts(receiptsPath)
+	}
+	if err != nil {
+		ms.Close()
+		return nil, err
+	}
+	return ms, nil
+}
+
+// Opens (or creates) the database at path, importing the legacy JSON catalog at
+// legacyPath if there is one
+func openMetadataStoreAt(path, legacyPath string) (*metadataStore, error) {
+	// A second node on the same account would block forever on the file lock without a timeout
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open metadata database: %w", err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{filesBucket, filesByPathBucket, downloadsBucket, settingsBucket, integrityBucket, watchedBucket, hashCacheBucket, reputationBucket, transferKeysBucket, spentPaymentsBucket, lockedDownloadsBucket, receiptsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create metadata buckets: %w", err)
+	}
+	if err := migrateLegacyMetadata(db, legacyPath); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := migrateSchema(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &metadataStore{db: db}, nil
+}
+
+// Runs the migrations the stored schema hasn't had yet, each in its own transaction
+// together with the version bump, so an interrupted upgrade resumes where it stopped.
+func migrateSchema(db *bolt.DB) error {
+	for {
+		var version int
+		err := db.View(func(tx *bolt.Tx) error {
+			if raw := tx.Bucket(settingsBucket).Get([]byte(schemaVersionSetting)); raw != nil {
+				return json.Unmarshal(raw, &version)
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to read schema version: %w", err)
+		}
+		if version > currentSchemaVersion {
+			return fmt.Errorf("metadata database has schema version %d, newer than this node supports (%d)", version, currentSchemaVersion)
+		}
+		if version == currentSchemaVersion {
+			return nil
+		}
+
+		err = db.Update(func(tx *bolt.Tx) error {
+			if err := schemaMigrations[version](tx); err != nil {
+				return err
+			}
+			next, _ := json.Marshal(version + 1)
+			return tx.Bucket(settingsBucket).Put([]byte(schemaVersionSetting), next)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to migrate metadata schema from version %d: %w", version, err)
+		}
+		log.Printf("Migrated metadata schema to version %d", version+1)
+	}
+}
+
+// Applies fn to every stored FileMetadata. Must be called in a write transaction.
+func rewriteFileMetadata(tx *bolt.Tx, fn func(*FileMetadata)) error {
+	var entries []FileMetadata
+	err := tx.Bucket(filesBucket).ForEach(func(k, v []byte) error {
+		var metadata FileMetadata
+		if err := json.Unmarshal(v, &metadata); err != nil {
+			return fmt.Errorf("failed to parse metadata for %s: %w", k, err)
+		}
+		entries = append(entries, metadata)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// bbolt doesn't allow writes while iterating, so rewrite afterwards
+	for _, metadata := range entries {
+		fn(&metadata)
+		if err := putFileMetadata(tx, metadata); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Fills in the details we can read off the file itself, leaving anything already set
+func fillFileDetails(metadata *FileMetadata, now time.Time) {
+	if metadata.FilePath != "" && metadata.FileName == "" {
+		metadata.FileName = filepath.Base(metadata.FilePath)
+	}
+	if info, err := os.Stat(metadata.FilePath); err == nil && metadata.Size == 0 {
+		metadata.Size = info.Size()
+	}
+	if metadata.MimeType == "" {
+		metadata.MimeType = detectMimeType(metadata.FilePath)
+	}
+	if metadata.CreatedAt.IsZero() {
+		metadata.CreatedAt = now
+	}
+	if metadata.UpdatedAt.IsZero() {
+		metadata.UpdatedAt = metadata.CreatedAt
+	}
+}
+
+// Guesses the MIME type from the extension, falling back to sniffing the first bytes
+func detectMimeType(path string) string {
+	if t := mime.TypeByExtension(filepath.Ext(path)); t != "" {
+		return t
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+	sample := make([]byte, 512)
+	n, _ := io.ReadFull(file, sample)
+	if n == 0 {
+		return ""
+	}
+	return http.DetectContentType(sample[:n])
+}
+
+// Splits a comma-separated tag list, dropping blanks and duplicates
+func parseTags(list string) []string {
+	var tags []string
+	seen := make(map[string]bool)
+	for _, tag := range strings.Split(list, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+	}
+	return tags
+}
+
+func (ms *metadataStore) Close() error {
+	return ms.db.Close()
+}
+
+// Imports the old JSON catalog on first start and renames it out of the way, so it is
+// only migrated once and is still there if anything needs to be recovered by hand.
+func migrateLegacyMetadata(db *bolt.DB, legacyPath string) error {
+	data, err := os.ReadFile(legacyPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read legacy metadata: %w", err)
+	}
+	var legacy []FileMetadata
+	if err := json.Unmarshal(data, &legacy); err != nil {
+		return fmt.Errorf("failed to parse legacy metadata: %w", err)
+	}
+
+	migrated := 0
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, metadata := range legacy {
+			if tx.Bucket(filesBucket).Get([]byte(metadata.CID)) != nil {
+				continue
+			}
+			if err := putFileMetadata(tx, metadata); err != nil {
+				return err
+			}
+			migrated++
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to migrate legacy metadata: %w", err)
+	}
+	if err := os.Rename(legacyPath, legacyPath+".migrated"); err != nil {
+		return fmt.Errorf("failed to retire legacy metadata file: %w", err)
+	}
+	log.Printf("Migrated %d shared files from %s into the metadata database", migrated, legacyPath)
+	return nil
+}
+
+// Stores metadata under its CID and indexes its path. Must be called in a write transaction.
+func putFileMetadata(tx *bolt.Tx, metadata FileMetadata) error {
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return fmt.Errorf("failed to encode metadata: %w", err)
+	}
+	if err := tx.Bucket(filesBucket).Put([]byte(metadata.CID), data); err != nil {
+		return err
+	}
+	if metadata.FilePath == "" {
+		return nil
+	}
+	return tx.Bucket(filesByPathBucket).Put([]byte(metadata.FilePath), []byte(metadata.CID))
+}
+
+// Decodes the metadata stored under cid; ok is false if there is none
+func getFileMetadata(tx *bolt.Tx, cid string) (metadata FileMetadata, ok bool, err error) {
+	data := tx.Bucket(filesBucket).Get([]byte(cid))
+	if data == nil {
+		return FileMetadata{}, false, nil
+	}
+	if err := json.Unmarshal(data, &metadata); err != nil {
+		return FileMetadata{}, false, fmt.Errorf("failed to parse metadata for %s: %w", cid, err)
+	}
+	return metadata, true, nil
+}
+
+// Drops cid and, if it still points at cid, its path index entry. Must be called in a write transaction.
+func deleteFileMetadata(tx *bolt.Tx, metadata FileMetadata) error {
+	byPath := tx.Bucket(filesByPathBucket)
+	if metadata.FilePath != "" && string(byPath.Get([]byte(metadata.FilePath))) == metadata.CID {
+		if err := byPath.Delete([]byte(metadata.FilePath)); err != nil {
+			return err
+		}
+	}
+	return tx.Bucket(filesBucket).Delete([]byte(metadata.CID))
+}
+
+func (ms *metadataStore) List() ([]FileMetadata, error) {
+	metadata := []FileMetadata{}
+	err := ms.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(filesBucket).ForEach(func(k, v []byte) error {
+			var entry FileMetadata
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return fmt.Errorf("failed to parse metadata for %s: %w", k, err)
+			}
+			metadata = append(metadata, entry)
+			return nil
+		})
+	})
+	return metadata, err
+}
+
+func (ms *metadataStore) Get(cid string) (FileMetadata, bool) {
+	var metadata FileMetadata
+	found := false
+	err := ms.db.View(func(tx *bolt.Tx) (err error) {
+		metadata, found, err = getFileMetadata(tx, cid)
+		return err
+	})
+	if err != nil {
+		log.Printf("Failed to read metadata for CID %s: %v", cid, err)
+		return FileMetadata{}, false
+	}
+	return metadata, found
+}
+
+func (ms *metadataStore) GetByPath(path string) (FileMetadata, bool) {
+	var metadata FileMetadata
+	found := false
+	err := ms.db.View(func(tx *bolt.Tx) (err error) {
+		cid := tx.Bucket(filesByPathBucket).Get([]byte(path))
+		if cid == nil {
+			return nil
+		}
+		metadata, found, err = getFileMetadata(tx, string(cid))
+		return err
+	})
+	if err != nil {
+		log.Printf("Failed to read metadata for %s: %v", path, err)
+		return FileMetadata{}, false
+	}
+	return metadata, found
+}
+
+// Adds a shared file, filling in its name, size and type. A CID that is already
+// listed is left as it is.
+func (ms *metadataStore) Add(newMetadata FileMetadata) error {
+	fillFileDetails(&newMetadata, time.Now())
+	duplicateFound := false
+	err := ms.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(filesBucket).Get([]byte(newMetadata.CID)) != nil {
+			duplicateFound = true
+			return nil
+		}
+		return putFileMetadata(tx, newMetadata)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to store metadata: %w", err)
+	}
+	if duplicateFound {
+		log.Println("Duplicate CID found. Skipping the addition of new metadata.")
+		return nil
+	}
+	log.Println("New metadata added successfully!")
+	return nil
+}
+
+// Modify applies fn to the entry for cid and stores the result, all in one transaction
+// so concurrent changes to the same entry can't overwrite each other. It reports
+// whether the entry existed.
+func (ms *metadataStore) Modify(cid string, fn func(*FileMetadata) error) (bool, error) {
+	found := false
+	err := ms.db.Update(func(tx *bolt.Tx) error {
+		metadata, ok, err := getFileMetadata(tx, cid)
+		if err != nil || !ok {
+			return err
+		}
+		found = true
+		previous := metadata
+		if err := fn(&metadata); err != nil {
+			return err
+		}
+		metadata.CID = cid
+		if previous.FilePath != metadata.FilePath {
+			if err := deleteFileMetadata(tx, previous); err != nil {
+				return err
+			}
+		}
+		return putFileMetadata(tx, metadata)
+	})
+	return found, err
+}
+
+// Counts a completed transfer of cid to a peer
+func (ms *metadataStore) CountDownload(cid string) {
+	_, err := ms.Modify(cid, func(metadata *FileMetadata) error {
+		metadata.DownloadCount++
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to count download of %s: %v", cid, err)
+	}
+}
+
+func (ms *metadataStore) Remove(cid string) error {
+	removed := false
+	err := ms.db.Update(func(tx *bolt.Tx) error {
+		metadata, ok, err := getFileMetadata(tx, cid)
+		if err != nil || !ok {
+			return err
+		}
+		removed = true
+		return deleteFileMetadata(tx, metadata)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to remove metadata: %w", err)
+	}
+	if removed {
+		log.Printf("Metadata for CID %s removed", cid)
+	}
+	return nil
+}
+
+// Remembers a verified download, replacing any earlier record for the same CID
+func (ms *metadataStore) RecordDownload(record downloadRecord) {
+	if record.Size == 0 {
+		if info, err := os.Stat(record.Path); err == nil {
+			record.Size = info.Size()
+		}
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		log.Printf("Failed to encode download record: %v", err)
+		return
+	}
+	err = ms.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(downloadsBucket).Put([]byte(record.CID), data)
+	})
+	if err != nil {
+		log.Printf("Failed to record download of %s: %v", record.CID, err)
+	}
+}
+
+func (ms *metadataStore) Downloads() ([]downloadRecord, error) {
+	records := []downloadRecord{}
+	err := ms.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(downloadsBucket).ForEach(func(k, v []byte) error {
+			var record downloadRecord
+			if err := json.Unmarshal(v, &record); err != nil {
+				return fmt.Errorf("failed to parse download record for %s: %w", k, err)
+			}
+			records = append(records, record)
+			return nil
+		})
+	})
+	return records, err
+}
+
+// Loads the setting stored under key into v and reports whether it was set
+func (ms *metadataStore) Setting(key string, v any) (bool, error) {
+	var data []byte
+	err := ms.db.View(func(tx *bolt.Tx) error {
+		if raw := tx.Bucket(settingsBucket).Get([]byte(key)); raw != nil {
+			data = append([]byte(nil), raw...)
+		}
+		return nil
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to read setting %s: %w", key, err)
+	}
+	if data == nil {
+		return false, nil
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return false, fmt.Errorf("failed to parse setting %s: %w", key, err)
+	}
+	return true, nil
+}
+
+func (ms *metadataStore) PutSetting(key string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to encode setting %s: %w", key, err)
+	}
+	err = ms.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(settingsBucket).Put([]byte(key), data)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to store setting %s: %w", key, err)
+	}
+	return nil
+}
+
+// Handler to list completed downloads, newest first
+func (h *dhtHandler) listDownloadsHandler(w http.ResponseWriter, r *http.Request) {
+	// Set CORS headers
+	w.Header().Set("Access-Control-Allow-Origin", "http://localhost:5173") // Change to your frontend's URL
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+
+	// Handle preflight OPTIONS request
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	records, err := catalog.Downloads()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].CompletedAt.After(records[j].CompletedAt) })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(records)
+}
+
+// writeFileAtomic replaces path with data by writing a temp file in the same directory
+// and renaming it over the original, so readers see either the old or the new contents.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
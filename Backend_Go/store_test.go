@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func openTestStore(t *testing.T) *metadataStore {
+	t.Helper()
+	dir := t.TempDir()
+	ms, err := openMetadataStoreAt(filepath.Join(dir, "test.db"), filepath.Join(dir, "legacy"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ms.Close() })
+	return ms
+}
+
+// Run with -race: every writer goes through its own bbolt transaction, so no update
+// may be lost however the goroutines interleave.
+func TestStoreConcurrentUpdates(t *testing.T) {
+	ms := openTestStore(t)
+
+	const (
+		shared  = 4  // entries every goroutine counts downloads of
+		workers = 16 // goroutines
+		rounds  = 25 // updates per goroutine per entry
+	)
+	for i := 0; i < shared; i++ {
+		if err := ms.Add(FileMetadata{CID: fmt.Sprintf("shared-%d", i), FilePath: fmt.Sprintf("/shared/%d", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for r := 0; r < rounds; r++ {
+				for i := 0; i < shared; i++ {
+					cid := fmt.Sprintf("shared-%d", i)
+					ms.CountDownload(cid)
+					_, err := ms.Modify(cid, func(m *FileMetadata) error {
+						m.Price++
+						return nil
+					})
+					if err != nil {
+						t.Error(err)
+					}
+				}
+				// Churn entries of our own alongside the shared ones
+				own := FileMetadata{CID: fmt.Sprintf("own-%d-%d", w, r), FilePath: fmt.Sprintf("/own/%d/%d", w, r)}
+				if err := ms.Add(own); err != nil {
+					t.Error(err)
+				}
+				if r%2 == 0 {
+					if err := ms.Remove(own.CID); err != nil {
+						t.Error(err)
+					}
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	for i := 0; i < shared; i++ {
+		m, found := ms.Get(fmt.Sprintf("shared-%d", i))
+		if !found {
+			t.Fatalf("shared-%d is gone", i)
+		}
+		if m.DownloadCount != workers*rounds {
+			t.Errorf("shared-%d: download count %d, want %d", i, m.DownloadCount, workers*rounds)
+		}
+		if m.Price != workers*rounds {
+			t.Errorf("shared-%d: price %v, want %d", i, m.Price, workers*rounds)
+		}
+	}
+
+	entries, err := ms.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := shared + workers*(rounds/2); len(entries) != want { // odd rounds keep their entry
+		t.Errorf("%d entries listed, want %d", len(entries), want)
+	}
+	for w := 0; w < workers; w++ {
+		for r := 0; r < rounds; r++ {
+			path := fmt.Sprintf("/own/%d/%d", w, r)
+			_, found := ms.GetByPath(path)
+			if found != (r%2 == 1) {
+				t.Errorf("%s: found by path %v, want %v", path, found, r%2 == 1)
+			}
+		}
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "index.json")
+	if err := writeFileAtomic(path, []byte("first"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFileAtomic(path, []byte("second"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "second" {
+		t.Errorf("got %q, want %q", data, "second")
+	}
+	assertDirHolds(t, dir, "index.json")
+}
+
+func TestWriteFileAtomicFailedRename(t *testing.T) {
+	dir := t.TempDir()
+	// A non-empty directory in the way makes the final rename fail
+	target := filepath.Join(dir, "index.json")
+	if err := os.MkdirAll(filepath.Join(target, "keep"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := writeFileAtomic(target, []byte("data"), 0644); err == nil {
+		t.Fatal("expected the rename onto a directory to fail")
+	}
+	info, err := os.Stat(target)
+	if err != nil || !info.IsDir() {
+		t.Fatalf("target was replaced: %v", err)
+	}
+	assertDirHolds(t, dir, "index.json")
+}
+
+// Fails unless dir contains exactly the named entries, so no temp file was left behind
+func assertDirHolds(t *testing.T, dir string, names ...string) {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, e := range entries {
+		got = append(got, e.Name())
+	}
+	if fmt.Sprint(got) != fmt.Sprint(names) {
+		t.Errorf("%s holds %v, want %v", dir, got, names)
+	}
+}
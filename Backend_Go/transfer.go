@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// transferHeader is the line a seller writes ahead of the file bytes on a
+// senddata 1.1.0 stream, e.g. "zstd encrypted=<id> price=1.5 wallet=<addr>".
+// The first field is always the codec; the rest are optional key=value pairs.
+type transferHeader struct {
+	Codec         string
+	TransferID    string // set when the payload is encrypted and the key must be bought
+	Price         float64
+	WalletAddress string
+}
+
+func (th transferHeader) Encrypted() bool {
+	return th.TransferID != ""
+}
+
+func (th transferHeader) String() string {
+	fields := []string{th.Codec}
+	if th.Encrypted() {
+		fields = append(fields,
+			"encrypted="+th.TransferID,
+			"price="+strconv.FormatFloat(th.Price, 'f', -1, 64),
+			"wallet="+th.WalletAddress,
+		)
+	}
+	return strings.Join(fields, " ")
+}
+
+func parseTransferHeader(line string) (transferHeader, error) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return transferHeader{}, fmt.Errorf("empty transfer header")
+	}
+	th := transferHeader{Codec: fields[0]}
+	if !isSupportedCodec(th.Codec) {
+		return transferHeader{}, fmt.Errorf("peer chose unsupported codec: %q", th.Codec)
+	}
+	for _, field := range fields[1:] {
+		key, value, _ := strings.Cut(field, "=")
+		switch key {
+		case "encrypted":
+			th.TransferID = value
+		case "price":
+			price, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return transferHeader{}, fmt.Errorf("invalid price in transfer header: %w", err)
+			}
+			th.Price = price
+		case "wallet":
+			th.WalletAddress = value
+		default:
+			// Unknown fields are ignored so newer sellers can add them
+		}
+	}
+	return th, nil
+}
+
+func readTransferHeader(r *bufio.Reader) (transferHeader, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return transferHeader{}, fmt.Errorf("failed to read transfer header: %w", err)
+	}
+	return parseTransferHeader(line)
+}
+
+// Outcome of fetching one CID from a seller
+type fetchResult struct {
+	TransportPath string
+	Protocol      string // negotiated senddata protocol ID
+	Codec         string
+	Written       int64
+	Locked        *lockedDownload // set when the file arrived encrypted and still has to be paid for
+}
+
+// Where fetchFromPeer writes a download for outputPath while it arrives. Only this
+// node ever writes to it, so it can be truncated safely.
+func downloadPartPath(outputPath string) string {
+	return outputPath + ".part"
+}
+
+// fetchFromPeer downloads cid from the target peer over the newest senddata version it
+// speaks into a part file and checks that it matches the CID; content that doesn't is
+// removed, counts against the peer and gives an errCIDMismatch error. Only then is it
+// renamed to outputPath, receipted and counted as a success. Paid files are stored
+// encrypted next to outputPath and returned as a locked download, to be checked once
+// they are unlocked. onProgress, if set, is called with the number of bytes written so far.
+func (h *dhtHandler) fetchFromPeer(ctx context.Context, targetID peer.ID, cid, outputPath string, onProgress func(int64)) (result fetchResult, err error) {
+	start := time.Now()
+	defer func() {
+		// A locked file can't be checked yet; unlocking it records how the transfer went
+		if result.Locked == nil {
+			recordTransfer(targetID, result.Written, time.Since(start), err)
+		}
+	}()
+
+	connectPath, err := connectToPeerPreferDirect(ctx, h.node, h.kadDHT, targetID)
+	if err != nil {
+		return result, fmt.Errorf("failed to connect to peer %s: %w", targetID, err)
+	}
+	s, err := h.node.NewStream(network.WithAllowLimitedConn(ctx, "senddata"), targetID, sendDataProtocols...)
+	if err != nil {
+		return result, fmt.Errorf("failed to open stream to %s: %w", targetID, err)
+	}
+	defer s.Close()
+	result.TransportPath = streamPath(s, connectPath)
+	result.Protocol = string(s.Protocol())
+	recordNegotiated(targetID, "senddata", s.Protocol())
+	log.Printf("Transfer of %s from %s is using a %s connection (%s)", cid, targetID, result.TransportPath, s.Protocol())
+
+	// Step 1: Send our peerID, the CID and, from 1.1.0 on, the codecs we accept
+	negotiate := sendDataNegotiates(s.Protocol())
+	request := fmt.Sprintf("%s,%s\n", h.node.ID().String(), cid)
+	if negotiate {
+		request = fmt.Sprintf("%s,%s,%s\n", h.node.ID().String(), cid, acceptedCodecs())
+	}
+	if _, err := s.Write([]byte(request)); err != nil {
+		return result, fmt.Errorf("failed to send request: %w", err)
+	}
+	log.Printf("Sent request to %s for file with CID: %s", targetID, cid)
+
+	// Step 2: Receive the transfer header (1.1.0 only), then the file
+	reader := bufio.NewReader(s)
+	header := transferHeader{Codec: codecIdentity}
+	if negotiate {
+		header, err = readTransferHeader(reader)
+		if err != nil {
+			return result, err
+		}
+	}
+	result.Codec = header.Codec
+
+	if header.Encrypted() {
+		// Paid file: keep the ciphertext until the key is bought. The receipt goes with
+		// the key release, once the unlocked file has been checked.
+		result.Locked, result.Written, err = storeLockedDownload(reader, header, targetID, cid, outputPath, start)
+		return result, err
+	}
+
+	body, err := newDecompressReader(header.Codec, reader)
+	if err != nil {
+		return result, fmt.Errorf("failed to set up %s decoder: %w", header.Codec, err)
+	}
+	defer body.Close()
+
+	// Receive into the .part file and only rename it over outputPath once it checks out.
+	// Opening outputPath itself would truncate whatever is there, which may be a copy
+	// hard-linked into the cache and being served to other peers.
+	partPath := downloadPartPath(outputPath)
+	file, err := os.Create(partPath)
+	if err != nil {
+		return result, fmt.Errorf("failed to create output file: %w", err)
+	}
+	defer os.Remove(partPath) // no-op once renamed into place
+	var dst io.Writer = file
+	if onProgress != nil {
+		dst = &progressWriter{w: file, onProgress: onProgress}
+	}
+	result.Written, err = io.Copy(dst, body)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return result, fmt.Errorf("failed to write file data: %w", err)
+	}
+
+	if err := verifyFileCID(partPath, cid); err != nil {
+		recordIntegrityFailure(targetID, err)
+		return result, fmt.Errorf("received file failed verification: %w", err)
+	}
+	if err := os.Rename(partPath, outputPath); err != nil {
+		return result, fmt.Errorf("failed to move file into place: %w", err)
+	}
+	log.Printf("File received and saved as '%s' (%d bytes, via %s, codec %s)", outputPath, result.Written, result.TransportPath, result.Codec)
+
+	if sendDataHasReceipts(s.Protocol()) {
+		// The decoder may stop at the end of its frame; read to the seller's close before answering
+		io.Copy(io.Discard, reader)
+		h.sendReceipt(s, cid, result.Written, "")
+	}
+	return result, nil
+}
+
+type progressWriter struct {
+	w          io.Writer
+	written    int64
+	onProgress func(int64)
+}
+
+func (pw *progressWriter) Write(p []byte) (int, error) {
+	n, err := pw.w.Write(p)
+	pw.written += int64(n)
+	pw.onProgress(pw.written)
+	return n, err
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	chunker "github.com/ipfs/boxo/chunker"
+	"github.com/ipfs/boxo/ipld/unixfs/importer/balanced"
+	"github.com/ipfs/boxo/ipld/unixfs/importer/helpers"
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+// How `ipfs add` addresses a file by default: a dag-pb UnixFS DAG rooted in a CIDv0
+var unixfsCIDOptions = cidOptions{Hash: "sha2-256", Version: 0, Codec: "dag-pb"}
+
+// discardDAG accepts the nodes the importer builds and keeps none of them. We serve
+// whole files over our own protocol, so only the root CID is needed.
+type discardDAG struct{}
+
+func (discardDAG) Get(ctx context.Context, c cid.Cid) (ipld.Node, error) {
+	return nil, ipld.ErrNotFound{Cid: c}
+}
+
+func (discardDAG) GetMany(ctx context.Context, cids []cid.Cid) <-chan *ipld.NodeOption {
+	out := make(chan *ipld.NodeOption, len(cids))
+	for _, c := range cids {
+		out <- &ipld.NodeOption{Err: ipld.ErrNotFound{Cid: c}}
+	}
+	close(out)
+	return out
+}
+
+func (discardDAG) Add(context.Context, ipld.Node) error        { return nil }
+func (discardDAG) AddMany(context.Context, []ipld.Node) error  { return nil }
+func (discardDAG) Remove(context.Context, cid.Cid) error       { return nil }
+func (discardDAG) RemoveMany(context.Context, []cid.Cid) error { return nil }
+
+// unixfsCID builds the same DAG the reference implementation does for a file: 256 KiB
+// fixed-size chunks in a balanced layout with the default links per node, UnixFS
+// leaves for CIDv0 and raw leaves for CIDv1. The root matches `ipfs add` (or
+// `ipfs add --cid-version=1` with the same hash).
+func unixfsCID(r io.Reader, opts cidOptions) (cid.Cid, error) {
+	params := helpers.DagBuilderParams{
+		Maxlinks:  helpers.DefaultLinksPerBlock,
+		RawLeaves: opts.Version == 1,
+		CidBuilder: cid.Prefix{
+			Version:  uint64(opts.Version),
+			Codec:    cid.DagProtobuf,
+			MhType:   supportedHashes[opts.Hash],
+			MhLength: -1,
+		},
+		Dagserv: discardDAG{},
+	}
+	builder, err := params.New(chunker.NewSizeSplitter(r, chunker.DefaultBlockSize))
+	if err != nil {
+		return cid.Undef, fmt.Errorf("failed to set up UnixFS importer: %w", err)
+	}
+	root, err := balanced.Layout(builder)
+	if err != nil {
+		return cid.Undef, fmt.Errorf("failed to build UnixFS DAG: %w", err)
+	}
+	return root.Cid(), nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ipfs/go-test/random"
+)
+
+// CIDs `ipfs add` gives the same bytes
+func TestUnixfsCIDMatchesIPFS(t *testing.T) {
+	// What boxo's own importer test expects: 10 MiB of seeded random bytes, 40 chunks
+	large := make([]byte, 10<<20)
+	random.NewSeededRand(0xdeadbeef).Read(large)
+
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"empty", nil, "QmbFMke1KXqnYyBBWxB74N4c5SBnJMVAiMNRcGu6x1AwQH"},
+		{"hello world", []byte("hello world\n"), "QmT78zSuBmuS4z925WZfrqQ1qHaJ56DQaTfyMUF7F8ff5o"},
+		{"multi-chunk", large, "QmPu94p2EkpSpgKdyz8eWomA7edAQN6maztoBycMZFixyz"},
+	}
+	for _, tt := range tests {
+		var progress int64
+		got, err := hashReader(bytes.NewReader(tt.data), unixfsCIDOptions, func(n int64) { progress = n })
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got.String() != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+		if progress != int64(len(tt.data)) {
+			t.Errorf("%s: reported %d bytes hashed, want %d", tt.name, progress, len(tt.data))
+		}
+	}
+}
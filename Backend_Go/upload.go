@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+)
+
+const (
+	// Form fields other than the file are small; anything longer is a malformed request
+	maxUploadFieldSize = 64 << 10
+
+	defaultMaxUploadBytes = 4 << 30 // 4 GiB
+)
+
+// Largest request body an upload may have. MAX_UPLOAD_BYTES overrides the default,
+// since the API listens on every interface.
+func maxUploadBytes() int64 {
+	if v := os.Getenv("MAX_UPLOAD_BYTES"); v != "" {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil && n > 0 {
+			return n
+		}
+		log.Printf("Ignoring invalid MAX_UPLOAD_BYTES %q", v)
+	}
+	return defaultMaxUploadBytes
+}
+
+// Reports a failure to read the client's upload, telling an oversized body apart
+func uploadReadError(err error) error {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return newAPIError(http.StatusRequestEntityTooLarge, errCodeInvalidRequest, "upload is larger than %d bytes", tooLarge.Limit)
+	}
+	return badRequest("failed to read upload: %v", err)
+}
+
+// Where uploaded files are kept, one directory per CID: <Downloads>/<node_id>-uploads
+func getUploadDir() (string, error) {
+	downloadPath, err := getDownloadPath()
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(downloadPath, node_id+"-uploads")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create upload directory: %w", err)
+	}
+	return dir, nil
+}
+
+// Reduces a client-supplied file name to a single safe path element
+func uploadFileName(name string) string {
+	name = filepath.Base(filepath.Clean("/" + strings.ReplaceAll(name, "\\", "/")))
+	if name == "/" || name == "." || name == ".." {
+		return "upload"
+	}
+	return name
+}
+
+// Where an upload ended up. Created is false when the same content was already stored
+// under the same name, in which case that copy was kept.
+type importedUpload struct {
+	Path    string
+	CID     cid.Cid
+	Created bool
+}
+
+// Deletes a freshly stored upload that isn't going to be listed after all
+func (u importedUpload) discard() {
+	if !u.Created {
+		return
+	}
+	os.Remove(u.Path)
+	os.Remove(filepath.Dir(u.Path)) // only goes if no other name is stored under the CID
+	if err := catalog.forgetCachedHashes(u.Path); err != nil {
+		log.Printf("Failed to forget cached CID of %s: %v", u.Path, err)
+	}
+}
+
+// Remembers why reading the client's upload failed, to tell a broken request apart
+// from our own storage failing
+type uploadSource struct {
+	r   io.Reader
+	err error
+}
+
+func (us *uploadSource) Read(p []byte) (int, error) {
+	n, err := us.r.Read(p)
+	if err != nil && err != io.EOF {
+		us.err = err
+	}
+	return n, err
+}
+
+// importUpload copies src into managed storage, hashing it as it is written. Content
+// that is already stored under the same CID and name is kept and the new copy dropped.
+// An upload that can't be read is a bad request; failing to store it is an internal error.
+func importUpload(src io.Reader, name string, opts cidOptions) (importedUpload, error) {
+	dir, err := getUploadDir()
+	if err != nil {
+		return importedUpload{}, err
+	}
+	tmp, err := os.CreateTemp(dir, ".upload-*")
+	if err != nil {
+		return importedUpload{}, fmt.Errorf("failed to create upload file: %w", err)
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed into place
+
+	source := &uploadSource{r: src}
+	c, err := hashReader(io.TeeReader(source, tmp), opts, nil)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if source.err != nil {
+		return importedUpload{}, uploadReadError(source.err)
+	}
+	if err != nil {
+		return importedUpload{}, fmt.Errorf("failed to store upload: %w", err)
+	}
+
+	target := filepath.Join(dir, c.String(), uploadFileName(name))
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return importedUpload{}, fmt.Errorf("failed to store upload: %w", err)
+	}
+	if _, err := os.Stat(target); err == nil {
+		return importedUpload{Path: target, CID: c}, nil
+	}
+	if err := os.Rename(tmp.Name(), target); err != nil {
+		return importedUpload{}, fmt.Errorf("failed to store upload: %w", err)
+	}
+	if info, err := os.Stat(target); err == nil {
+		rememberFileCID(target, opts, info, c)
+	}
+	return importedUpload{Path: target, CID: c, Created: true}, nil
+}
+
+// Reads a multipart upload, importing the first file part and collecting the other
+// fields into values. Fields may come before or after the file, so if the rest of the
+// request turns out to be broken the imported file is discarded again.
+func importMultipartUpload(r *http.Request, values url.Values, opts cidOptions) (upload importedUpload, err error) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return importedUpload{}, badRequest("%v", err)
+	}
+	defer func() {
+		if err != nil {
+			upload.discard()
+		}
+	}()
+	imported := false
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return upload, uploadReadError(err)
+		}
+		if part.FileName() != "" && !imported {
+			if upload, err = importUpload(part, part.FileName(), opts); err != nil {
+				return upload, err
+			}
+			imported = true
+			continue
+		}
+		value, err := io.ReadAll(io.LimitReader(part, maxUploadFieldSize))
+		if err != nil {
+			return upload, uploadReadError(err)
+		}
+		if part.FormName() != "" && values.Get(part.FormName()) == "" {
+			values.Set(part.FormName(), string(value))
+		}
+	}
+	if !imported {
+		return upload, badRequest("upload has no file part")
+	}
+	return upload, nil
+}
+
+func parseUploadPrice(values url.Values) (float64, error) {
+	price, err := strconv.ParseFloat(values.Get("price"), 64)
+	if err != nil || price < 0 {
+		return 0, badRequest("invalid price")
+	}
+	return price, nil
+}
+
+// advertiseUpload imports the file in the request body into the node's upload
+// directory and lists it, reporting whether it was already listed. The body is either
+// multipart form data with a file part, or the raw file with its name in ?filename=
+// or a Content-Disposition header. price, description, walletaddress and tags come
+// from the query or form fields; hash, cidversion, codec and mode from the query.
+// A raw body is only read once the query checks out; a multipart upload whose fields
+// turn out to be invalid is removed again, as is a new copy of content already listed
+// under another path. Bodies over maxUploadBytes are refused.
+func (h *dhtHandler) advertiseUpload(w http.ResponseWriter, r *http.Request) (FileMetadata, bool, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadBytes())
+	values := r.URL.Query()
+	opts, err := cidOptionsFromQuery(values)
+	if err != nil {
+		return FileMetadata{}, false, badRequest("%v", err)
+	}
+
+	var upload importedUpload
+	var price float64
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "multipart/form-data" {
+		if upload, err = importMultipartUpload(r, values, opts); err != nil {
+			log.Printf("Upload failed: %v", err)
+			return FileMetadata{}, false, err
+		}
+		if price, err = parseUploadPrice(values); err != nil {
+			upload.discard()
+			return FileMetadata{}, false, err
+		}
+	} else {
+		if price, err = parseUploadPrice(values); err != nil {
+			return FileMetadata{}, false, err
+		}
+		name := values.Get("filename")
+		if name == "" {
+			if _, params, err := mime.ParseMediaType(r.Header.Get("Content-Disposition")); err == nil {
+				name = params["filename"]
+			}
+		}
+		if name == "" {
+			return FileMetadata{}, false, badRequest("missing filename")
+		}
+		if upload, err = importUpload(r.Body, name, opts); err != nil {
+			log.Printf("Upload failed: %v", err)
+			return FileMetadata{}, false, err
+		}
+	}
+
+	// The upload seeded the hash cache, so this doesn't read the file again
+	_, exists, err := h.advertiseFile(context.Background(), FileMetadata{
+		FilePath:        upload.Path,
+		FileDescription: values.Get("description"),
+		Price:           price,
+		WalletAddress:   values.Get("walletaddress"),
+		Tags:            parseTags(values.Get("tags")),
+	}, opts, false)
+	if err != nil {
+		upload.discard()
+		return FileMetadata{}, false, err
+	}
+	metadata, _ := catalog.Get(upload.CID.String())
+	if exists && metadata.FilePath != upload.Path {
+		upload.discard()
+		return metadata, true, nil
+	}
+	log.Printf("Successfully advertised uploaded file %s as CID %s", upload.Path, upload.CID)
+	return metadata, exists, nil
+}
+
+// Handler for uploads, see advertiseUpload
+func (h *dhtHandler) uploadAdvertiseHandler(w http.ResponseWriter, r *http.Request) {
+	// Set CORS headers
+	w.Header().Set("Access-Control-Allow-Origin", "http://localhost:5173") // Change to your frontend's URL
+	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Disposition")
+
+	// Handle preflight OPTIONS request
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	metadata, exists, err := h.advertiseUpload(w, r)
+	if err != nil {
+		writeLegacyError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !exists {
+		w.WriteHeader(http.StatusCreated)
+	}
+	json.NewEncoder(w).Encode(metadata)
+}
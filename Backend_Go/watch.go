@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	folderPollInterval    = 30 * time.Second
+	folderSettleDelay     = 2 * time.Second // between the two polls that pick up a new folder's files
+	watchedFoldersSetting = "watched_folders"
+)
+
+// A directory whose files are shared automatically. DescriptionTemplate may use
+// {name} for the file name and {path} for its path relative to the folder.
+type watchedFolder struct {
+	Path                string   `json:"path"`
+	Price               float64  `json:"price"`
+	WalletAddress       string   `json:"walletaddress"`
+	DescriptionTemplate string   `json:"description_template"`
+	Tags                []string `json:"tags,omitempty"`
+}
+
+func (wf watchedFolder) describe(path string) string {
+	rel, err := filepath.Rel(wf.Path, path)
+	if err != nil {
+		rel = filepath.Base(path)
+	}
+	return strings.NewReplacer("{name}", filepath.Base(path), "{path}", filepath.ToSlash(rel)).Replace(wf.DescriptionTemplate)
+}
+
+// What the watcher last advertised for a file, keyed by its absolute path
+type watchedFile struct {
+	Folder  string    `json:"folder"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	CID     string    `json:"cid"`
+}
+
+func (ms *metadataStore) watchedFiles() (map[string]watchedFile, error) {
+	files := make(map[string]watchedFile)
+	err := ms.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(watchedBucket).ForEach(func(k, v []byte) error {
+			var file watchedFile
+			if err := json.Unmarshal(v, &file); err != nil {
+				return fmt.Errorf("failed to parse watched file %s: %w", k, err)
+			}
+			files[string(k)] = file
+			return nil
+		})
+	})
+	return files, err
+}
+
+func (ms *metadataStore) putWatchedFile(path string, file watchedFile) error {
+	data, err := json.Marshal(file)
+	if err != nil {
+		return err
+	}
+	return ms.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(watchedBucket).Put([]byte(path), data)
+	})
+}
+
+func (ms *metadataStore) deleteWatchedFile(path string) error {
+	return ms.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(watchedBucket).Delete([]byte(path))
+	})
+}
+
+func readWatchedFolders() ([]watchedFolder, error) {
+	folders := []watchedFolder{}
+	if _, err := catalog.Setting(watchedFoldersSetting, &folders); err != nil {
+		return nil, err
+	}
+	return folders, nil
+}
+
+// Guards the folder list and pendingWatched. Polls hold it while they walk the folders,
+// not while they hash and advertise what they found.
+var folderWatchMu sync.Mutex
+
+// Serializes polls, so two never advertise or withdraw the same file at once
+var folderPollMu sync.Mutex
+
+// Size and mtime seen on the previous poll for files not yet advertised. A file is
+// only picked up once it looks the same on two polls in a row, so we don't hash one
+// that is still being copied in.
+var pendingWatched = make(map[string]watchedFile)
+
+// Withdraws a listing the watcher made, unless the CID has since been listed for another path
+func withdrawWatched(path string, file watchedFile) {
+	if metadata, found := catalog.Get(file.CID); found && metadata.FilePath == path {
+		if err := catalog.Remove(file.CID); err != nil {
+			log.Printf("%v", err)
+			return
+		}
+		log.Printf("Withdrew %s (CID %s) from watched folder %s", path, file.CID, file.Folder)
+	}
+}
+
+// A file a poll found ready to advertise, and what the watcher advertised for it before
+type watchedChange struct {
+	path     string
+	folder   watchedFolder
+	state    watchedFile
+	previous watchedFile
+	known    bool
+}
+
+// Walks the watched folders under folderWatchMu and works out what the poll has to do:
+// the files that are new or changed and have looked the same for two polls, the tracked
+// files that are gone, and how many files are still waiting to look stable.
+func scanWatchedFolders(tracked map[string]watchedFile) (changes []watchedChange, gone []string, waiting int, err error) {
+	folderWatchMu.Lock()
+	defer folderWatchMu.Unlock()
+
+	folders, err := readWatchedFolders()
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	seen := make(map[string]bool)
+	for _, folder := range folders {
+		err := filepath.WalkDir(folder.Path, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return nil // skip what we can't read, keep walking the rest
+			}
+			if strings.HasPrefix(d.Name(), ".") && path != folder.Path {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !d.Type().IsRegular() {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return nil
+			}
+			seen[path] = true
+			state := watchedFile{Folder: folder.Path, Size: info.Size(), ModTime: info.ModTime()}
+
+			previous, known := tracked[path]
+			if known && previous.Size == state.Size && previous.ModTime.Equal(state.ModTime) {
+				return nil
+			}
+			if pending, ok := pendingWatched[path]; !ok || pending.Size != state.Size || !pending.ModTime.Equal(state.ModTime) {
+				pendingWatched[path] = state
+				return nil
+			}
+			delete(pendingWatched, path)
+			changes = append(changes, watchedChange{path: path, folder: folder, state: state, previous: previous, known: known})
+			return nil
+		})
+		if err != nil {
+			log.Printf("Failed to scan watched folder %s: %v", folder.Path, err)
+		}
+	}
+
+	// Whatever we tracked but didn't see this time was deleted, or its folder is no longer watched
+	for path := range tracked {
+		if !seen[path] {
+			gone = append(gone, path)
+		}
+	}
+	for path := range pendingWatched {
+		if !seen[path] {
+			delete(pendingWatched, path)
+		}
+	}
+	return changes, gone, len(pendingWatched), nil
+}
+
+// Polls every watched folder once: new and changed files are advertised, files that
+// went away are withdrawn. Hashing and providing happen outside folderWatchMu, so the
+// folder list can be read and changed meanwhile. Returns how many files are still
+// waiting to look stable.
+func (h *dhtHandler) pollWatchedFolders(ctx context.Context) int {
+	folderPollMu.Lock()
+	defer folderPollMu.Unlock()
+
+	tracked, err := catalog.watchedFiles()
+	if err != nil {
+		log.Printf("%v", err)
+		return 0
+	}
+	changes, gone, pending, err := scanWatchedFolders(tracked)
+	if err != nil {
+		log.Printf("Failed to read watched folders: %v", err)
+		return 0
+	}
+
+	for _, change := range changes {
+		if change.known {
+			withdrawWatched(change.path, change.previous)
+		}
+		c, _, err := h.advertiseFile(ctx, FileMetadata{
+			FilePath:        change.path,
+			FileDescription: change.folder.describe(change.path),
+			Price:           change.folder.Price,
+			WalletAddress:   change.folder.WalletAddress,
+			Tags:            change.folder.Tags,
+		}, nodeCIDOptions(), false)
+		if err != nil {
+			log.Printf("Failed to advertise watched file %s: %v", change.path, err)
+			continue
+		}
+		change.state.CID = c.String()
+		if err := catalog.putWatchedFile(change.path, change.state); err != nil {
+			log.Printf("Failed to track watched file %s: %v", change.path, err)
+		}
+		log.Printf("Advertised watched file %s as CID %s", change.path, c)
+	}
+
+	for _, path := range gone {
+		withdrawWatched(path, tracked[path])
+		if err := catalog.deleteWatchedFile(path); err != nil {
+			log.Printf("%v", err)
+		}
+	}
+	return pending
+}
+
+// Polls the watched folders every folderPollInterval until ctx is done
+func (h *dhtHandler) runFolderWatcher(ctx context.Context) {
+	ticker := time.NewTicker(folderPollInterval)
+	defer ticker.Stop()
+	for {
+		h.pollWatchedFolders(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Handler for watched folders: GET lists them, POST adds or updates one (folderpath,
+// price, walletaddress, description, tags) and DELETE stops watching ?folderpath=,
+// withdrawing the files it shared. New settings apply to files picked up afterwards.
+// A new folder's files are listed a few seconds after the POST returns, once a second
+// poll has seen them unchanged.
+func (h *dhtHandler) watchedFoldersHandler(w http.ResponseWriter, r *http.Request) {
+	// Set CORS headers
+	w.Header().Set("Access-Control-Allow-Origin", "http://localhost:5173") // Change to your frontend's URL
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+
+	// Handle preflight OPTIONS request
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	folderWatchMu.Lock()
+	folders, err := readWatchedFolders()
+	if err != nil {
+		folderWatchMu.Unlock()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		query := r.URL.Query()
+		folderPath, err := filepath.Abs(query.Get("folderpath"))
+		if err != nil || query.Get("folderpath") == "" {
+			folderWatchMu.Unlock()
+			http.Error(w, "Invalid folderpath", http.StatusBadRequest)
+			return
+		}
+		// Watch the real directory, so the paths the poller finds match the canonical ones it lists
+		if resolved, err := filepath.EvalSymlinks(folderPath); err == nil {
+			folderPath = resolved
+		}
+
+		// Drop any existing entry for the folder; POST puts the new settings back
+		kept := folders[:0]
+		for _, folder := range folders {
+			if folder.Path != folderPath {
+				kept = append(kept, folder)
+			}
+		}
+		folders = kept
+
+		if r.Method == http.MethodPost {
+			info, err := os.Stat(folderPath)
+			if err != nil || !info.IsDir() {
+				folderWatchMu.Unlock()
+				http.Error(w, "folderpath must be an existing directory", http.StatusBadRequest)
+				return
+			}
+			price, err := strconv.ParseFloat(query.Get("price"), 64)
+			if err != nil || price < 0 {
+				folderWatchMu.Unlock()
+				http.Error(w, "Invalid price", http.StatusBadRequest)
+				return
+			}
+			template := query.Get("description")
+			if template == "" {
+				template = "{name}"
+			}
+			folders = append(folders, watchedFolder{
+				Path:                folderPath,
+				Price:               price,
+				WalletAddress:       query.Get("walletaddress"),
+				DescriptionTemplate: template,
+				Tags:                parseTags(query.Get("tags")),
+			})
+		}
+		if err := catalog.PutSetting(watchedFoldersSetting, folders); err != nil {
+			folderWatchMu.Unlock()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	folderWatchMu.Unlock()
+
+	if r.Method != http.MethodGet {
+		// Pick up (or withdraw) the folder's files now rather than on the next tick. A
+		// file is only advertised once two polls see it unchanged, so the first poll just
+		// notes the new folder's files and a second one shortly after advertises them.
+		go func() {
+			if h.pollWatchedFolders(context.Background()) > 0 {
+				time.Sleep(folderSettleDelay)
+				h.pollWatchedFolders(context.Background())
+			}
+		}()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(folders)
+}
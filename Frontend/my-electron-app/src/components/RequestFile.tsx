@@ -45,7 +45,7 @@ export class RequestFile extends React.Component<RequestFileProps, RequestFileSt
 
     try {
       const response = await axios.get('http://localhost:6100/providers/', {
-        params: { targetCID: searchTerm },
+        params: { targetCID: searchTerm, sort: 'reputation' },
       });
 
       // Parse the response